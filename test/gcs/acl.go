@@ -0,0 +1,217 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// acl.go defines functions managing gcs access control lists and checking access
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrUniformAccess is returned when gcs rejects an ACL operation because the bucket
+// has uniform bucket-level access (formerly Bucket Policy Only) enabled,
+// on such buckets access is controlled through IAM only.
+var ErrUniformAccess = errors.New("gcs: bucket has uniform bucket-level access enabled, ACLs don't apply")
+
+// SetBucketDefaultACL sets the default object ACL of the bucket, so that objects created
+// afterwards without an explicit ACL inherit the entity/role pair, e.g. "allUsers"/"READER".
+// Existing objects are not changed.
+// Buckets with uniform bucket-level access ignore ACLs, ErrUniformAccess is returned for them.
+func SetBucketDefaultACL(ctx context.Context, bucketName, entity, role string) error {
+	err := client.Bucket(bucketName).DefaultObjectACL().Set(ctx, storage.ACLEntity(entity), storage.ACLRole(role))
+	if isUniformAccessError(err) {
+		return ErrUniformAccess
+	}
+	return err
+}
+
+// hasUniformAccess checks if the bucket has uniform bucket-level access enabled, which the
+// vendored storage client doesn't expose in bucket attrs, by probing its default object ACL.
+func hasUniformAccess(ctx context.Context, bucketName string) (bool, error) {
+	_, err := client.Bucket(bucketName).DefaultObjectACL().List(ctx)
+	if isUniformAccessError(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// isUniformAccessError checks if err is gcs refusing ACLs because of uniform bucket-level access
+func isUniformAccessError(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok || e.Code != http.StatusBadRequest {
+		return false
+	}
+	msg := strings.ToLower(e.Message)
+	return strings.Contains(msg, "uniform bucket-level access") || strings.Contains(msg, "bucket policy only")
+}
+
+// Publish copies srcPath to dstPath, makes the copy readable by allUsers, and returns its public URL.
+// ACLs can't make files public on buckets with uniform bucket-level access, ErrUniformAccess
+// is returned for them before anything is copied; grant allUsers the Storage Object Viewer
+// IAM role on such buckets instead.
+func Publish(ctx context.Context, srcBucket, srcPath, dstBucket, dstPath string) (publicURL string, err error) {
+	uniform, err := hasUniformAccess(ctx, dstBucket)
+	if err != nil {
+		return "", err
+	}
+	if uniform {
+		return "", ErrUniformAccess
+	}
+	if err := Copy(ctx, srcBucket, srcPath, dstBucket, dstPath); err != nil {
+		return "", err
+	}
+	err = createStorageObject(dstBucket, dstPath).ACL().Set(ctx, storage.AllUsers, storage.RoleReader)
+	if isUniformAccessError(err) {
+		return "", ErrUniformAccess
+	}
+	if err != nil {
+		return "", err
+	}
+	return PublicURL(dstBucket, dstPath), nil
+}
+
+// AuditPublicAccess returns the files under prefix whose ACL grants access to allUsers or
+// allAuthenticatedUsers. ACLs come with the listing, so no request is made per file, but
+// listing them requires OWNER access to the files.
+// Object ACLs don't apply on buckets with uniform bucket-level access, ErrUniformAccess is
+// returned for them; their public access is granted through the bucket IAM policy instead.
+func AuditPublicAccess(ctx context.Context, bucketName, prefix string) ([]string, error) {
+	uniform, err := hasUniformAccess(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if uniform {
+		return nil, ErrUniformAccess
+	}
+	var public []string
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		for _, rule := range attrs.ACL {
+			if rule.Entity == storage.AllUsers || rule.Entity == storage.AllAuthenticatedUsers {
+				public = append(public, attrs.Name)
+				break
+			}
+		}
+		return nil
+	})
+	return public, err
+}
+
+// objectReaderRoles are the predefined bucket IAM roles granting read access to all objects
+var objectReaderRoles = []iam.RoleName{
+	"roles/storage.objectViewer",
+	"roles/storage.objectAdmin",
+	"roles/storage.admin",
+	"roles/storage.legacyObjectReader",
+	"roles/storage.legacyObjectOwner",
+}
+
+// CheckReadAccess returns the files under prefix that principal can't read. principal is an IAM
+// member, like "serviceAccount:ci@project.iam.gserviceaccount.com", "user:", "group:" or
+// "domain:" followed by an email or domain, "allUsers" or "allAuthenticatedUsers". Access granted by the bucket IAM
+// policy covers all files, only predefined roles are recognized. Otherwise, on buckets with
+// fine-grained access, each file's ACL is checked, as returned by the listing, which requires
+// OWNER access to the files. Project level IAM roles, custom roles and project ACL entities
+// can't be resolved, so the result may list files principal can actually read.
+func CheckReadAccess(ctx context.Context, bucketName, prefix, principal string) ([]string, error) {
+	entities, err := aclEntities(principal)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := client.Bucket(bucketName).IAM().Policy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if iamGrantsRead(policy, principal) {
+		return nil, nil
+	}
+	uniform, err := hasUniformAccess(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	var unreadable []string
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if uniform || !aclGrantsRead(attrs.ACL, entities) {
+			unreadable = append(unreadable, attrs.Name)
+		}
+		return nil
+	})
+	return unreadable, err
+}
+
+// iamGrantsRead checks if the policy grants principal, directly or as part of everyone, a role
+// reading all objects
+func iamGrantsRead(policy *iam.Policy, principal string) bool {
+	for _, role := range objectReaderRoles {
+		if policy.HasRole(principal, role) || policy.HasRole(string(storage.AllUsers), role) {
+			return true
+		}
+		if principal != string(storage.AllUsers) && policy.HasRole(string(storage.AllAuthenticatedUsers), role) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclEntities returns the ACL entities granting access to the IAM member principal
+func aclEntities(principal string) ([]storage.ACLEntity, error) {
+	if principal == string(storage.AllUsers) {
+		return []storage.ACLEntity{storage.AllUsers}, nil
+	}
+	entities := []storage.ACLEntity{storage.AllUsers, storage.AllAuthenticatedUsers}
+	if principal == string(storage.AllAuthenticatedUsers) {
+		return entities, nil
+	}
+	parts := strings.SplitN(principal, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid principal %q: must be an IAM member like \"user:name@example.com\"", principal)
+	}
+	switch kind, id := parts[0], parts[1]; kind {
+	case "user", "serviceAccount":
+		entities = append(entities, storage.ACLEntity("user-"+id))
+		if i := strings.LastIndex(id, "@"); i >= 0 {
+			entities = append(entities, storage.ACLEntity("domain-"+id[i+1:]))
+		}
+	case "group":
+		entities = append(entities, storage.ACLEntity("group-"+id))
+	case "domain":
+		entities = append(entities, storage.ACLEntity("domain-"+id))
+	default:
+		return nil, fmt.Errorf("invalid principal %q: unsupported member type %q", principal, kind)
+	}
+	return entities, nil
+}
+
+// aclGrantsRead checks if any rule of acl is for one of entities, all ACL roles allow reading
+func aclGrantsRead(acl []storage.ACLRule, entities []storage.ACLEntity) bool {
+	for _, rule := range acl {
+		for _, e := range entities {
+			if strings.EqualFold(string(rule.Entity), string(e)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// archive.go defines functions inspecting archives stored in gcs without extracting them
+
+package gcs
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+)
+
+// IterTarEntries streams the .tar or .tar.gz file through a tar reader and calls fn for each entry,
+// with r reading the entry's content. Iteration stops at the first error returned by fn.
+func IterTarEntries(ctx context.Context, bucketName, filePath string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src, err := maybeGunzip(limitByBudget(ctx, f))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// atomicset.go defines uploads of sets of files that should appear together
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// stagingDir is the directory holding files staged before being moved to their final path
+const stagingDir = ".staging"
+
+// UploadAtomicSet uploads objects, a map of file paths to contents, so that either all or none of
+// them appear. All files are first uploaded under a staging directory, and only once they all
+// succeeded are they copied to their final paths. Staged files are deleted in any case, even
+// once ctx is canceled.
+// This is best-effort, not truly atomic: consumers may still see a partial set while the
+// final copies happen, and a copy failing midway leaves the already copied files in place.
+func UploadAtomicSet(ctx context.Context, bucketName string, objects map[string][]byte) error {
+	for filePath := range objects {
+		if err := checkKeyPolicy(filePath); err != nil {
+			return err
+		}
+	}
+	staging := path.Join(stagingDir, fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63()))
+	staged := newTempObjects(bucketName)
+	defer staged.cleanup()
+
+	for filePath, data := range objects {
+		handle, err := createDestinationObject(bucketName, staged.add(path.Join(staging, filePath)))
+		if err != nil {
+			return err
+		}
+		attrs := &storage.ObjectAttrs{ContentType: inferContentType(filePath)}
+		if _, err := writeObject(ctx, handle, data, attrs); err != nil {
+			return fmt.Errorf("failed staging %q: %v", filePath, err)
+		}
+	}
+	for filePath := range objects {
+		if err := Copy(ctx, bucketName, path.Join(staging, filePath), bucketName, filePath); err != nil {
+			return fmt.Errorf("failed moving %q to its final path: %v", filePath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// audit.go defines the audit log of the operations made by this package
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// auditQueueSize is the number of records an AuditSink queues between two flushes, and the
+	// number it keeps waiting for an append while appends fail, records beyond are dropped rather
+	// than slowing operations down or growing without bound
+	auditQueueSize = 4096
+	// auditFlushTimeout bounds each append to the audit log
+	auditFlushTimeout = 30 * time.Second
+)
+
+// AuditRecord is an operation logged by an AuditSink
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Who       string    `json:"who"`
+	Operation string    `json:"operation"`
+	Bucket    string    `json:"bucket"`
+	Path      string    `json:"path"`
+	Bytes     int64     `json:"bytes"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditSink appends a record of each Upload, UploadReader, Download, Read, ReadWithAttrs and Copy
+// call to an audit log file, once set with SetAuditSink. Records are queued without blocking the
+// operations, and appended every interval as newline delimited JSON, by composing the log with a
+// file of the new records. Records failing to be appended are retried on the next flush, and
+// records are dropped if the queue is full, the number dropped is logged.
+// GCS caps the number of files composed into one, so once the log reaches that many appends,
+// its content is moved to "<logPath>.<generation>" and the log starts over.
+type AuditSink struct {
+	bucketName string
+	logPath    string
+	who        string
+	records    chan AuditRecord
+	done       chan struct{}
+	closed     chan error
+	mu         sync.Mutex
+	dropped    int
+}
+
+var auditSink *AuditSink
+
+// SetAuditSink makes operations log to sink, nil, the default, disables auditing.
+// Like Authenticate, it should be called before any other function.
+func SetAuditSink(sink *AuditSink) {
+	auditSink = sink
+}
+
+// NewAuditSink creates an AuditSink appending records to logPath every interval, with who,
+// e.g. a job or service account name, as the author of the operations. Close must be called
+// once done to append the last records.
+func NewAuditSink(bucketName, logPath, who string, interval time.Duration) *AuditSink {
+	s := &AuditSink{
+		bucketName: bucketName,
+		logPath:    logPath,
+		who:        who,
+		records:    make(chan AuditRecord, auditQueueSize),
+		done:       make(chan struct{}),
+		closed:     make(chan error, 1),
+	}
+	go s.run(interval)
+	return s
+}
+
+// Close stops the sink and appends the queued records, returning the error of that last append.
+// Operations made after Close aren't logged.
+func (s *AuditSink) Close() error {
+	close(s.done)
+	return <-s.closed
+}
+
+// record queues r, dropping it if the queue is full
+func (s *AuditSink) record(r AuditRecord) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	select {
+	case s.records <- r:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+}
+
+// run appends the queued records every interval, until Close is called
+func (s *AuditSink) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var pending auditBatch
+	for {
+		select {
+		case r := <-s.records:
+			s.encode(&pending, r)
+		case <-ticker.C:
+			if err := s.flush(&pending); err != nil {
+				log.Printf("Failed appending to audit log %q: %v", s.logPath, err)
+			}
+		case <-s.done:
+			for len(s.records) > 0 {
+				s.encode(&pending, <-s.records)
+			}
+			s.closed <- s.flush(&pending)
+			return
+		}
+	}
+}
+
+// auditBatch is the records waiting to be appended to the audit log
+type auditBatch struct {
+	lines   bytes.Buffer
+	records int
+}
+
+// encode appends r to pending as a JSON line, dropping it if pending is full
+func (s *AuditSink) encode(pending *auditBatch, r AuditRecord) {
+	if pending.records >= auditQueueSize {
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	pending.lines.Write(append(line, '\n'))
+	pending.records++
+}
+
+// flush appends pending to the audit log, emptying it on success
+func (s *AuditSink) flush(pending *auditBatch) error {
+	s.mu.Lock()
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d records of audit log %q, the queue was full", dropped, s.logPath)
+	}
+	if pending.records == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditFlushTimeout)
+	defer cancel()
+	if err := appendObject(ctx, s.bucketName, s.logPath, pending.lines.Bytes()); err != nil {
+		return err
+	}
+	pending.lines.Reset()
+	pending.records = 0
+	return nil
+}
+
+const (
+	// maxComposedComponents is the number of files gcs allows composing into a single file
+	maxComposedComponents = 1024
+	// componentsMetadata is the metadata key appendObject counts the components of a file under
+	componentsMetadata = "components"
+)
+
+// appendObject appends data to the file, creating it if needed. The data is written to a temporary
+// file composed after the current content, which fails if the file changed meanwhile. Once the
+// file has as many components as gcs allows, its content is moved to "<filePath>.<generation>"
+// and the file replaced by data.
+func appendObject(ctx context.Context, bucketName, filePath string, data []byte) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	attrs, err := handle.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		created := &storage.ObjectAttrs{ContentType: "application/x-ndjson"}
+		_, err = writeObject(ctx, handle.If(storage.Conditions{DoesNotExist: true}), data, created)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	components, err := strconv.Atoi(attrs.Metadata[componentsMetadata])
+	if err != nil {
+		// Files not created by appendObject are counted as a single component.
+		components = 1
+	}
+	if components >= maxComposedComponents {
+		return rotateObject(ctx, bucketName, filePath, attrs, data)
+	}
+	temps := newTempObjects(bucketName)
+	defer temps.cleanup()
+	chunk, err := createDestinationObject(bucketName, temps.add(tempPath(filePath, "append")))
+	if err != nil {
+		return err
+	}
+	if _, err := writeObject(ctx, chunk, data, nil); err != nil {
+		return err
+	}
+	composer := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).ComposerFrom(handle.Generation(attrs.Generation), chunk)
+	composer.ContentType = attrs.ContentType
+	composer.Metadata = map[string]string{componentsMetadata: strconv.Itoa(components + 1)}
+	_, err = composer.Run(ctx)
+	return err
+}
+
+// rotateObject copies the attrs generation of the file to "<filePath>.<generation>", then replaces
+// the file with data unless it changed meanwhile
+func rotateObject(ctx context.Context, bucketName, filePath string, attrs *storage.ObjectAttrs, data []byte) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	rotated, err := createDestinationObject(bucketName, fmt.Sprintf("%s.%d", filePath, attrs.Generation))
+	if err != nil {
+		return err
+	}
+	copier := rotated.CopierFrom(handle.Generation(attrs.Generation))
+	err = withRetry(ctx, bucketName, func() error {
+		_, err := copier.Run(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed rotating %q: %v", filePath, err)
+	}
+	created := &storage.ObjectAttrs{ContentType: attrs.ContentType}
+	_, err = writeObject(ctx, handle.If(storage.Conditions{GenerationMatch: attrs.Generation}), data, created)
+	return err
+}
+
+// auditOp records an operation with the audit sink, if any
+func auditOp(operation, bucketName, filePath string, n int64, err error) {
+	if auditSink == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:      time.Now().UTC(),
+		Who:       auditSink.who,
+		Operation: operation,
+		Bucket:    bucketName,
+		Path:      filePath,
+		Bytes:     n,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	auditSink.record(r)
+}
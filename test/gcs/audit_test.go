@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestAuditBatchFull(t *testing.T) {
+	s := &AuditSink{}
+	var pending auditBatch
+	for i := 0; i < auditQueueSize+3; i++ {
+		s.encode(&pending, AuditRecord{Operation: "read"})
+	}
+	if pending.records != auditQueueSize {
+		t.Errorf("Pending records = %d, want %d", pending.records, auditQueueSize)
+	}
+	if s.dropped != 3 {
+		t.Errorf("Dropped records = %d, want 3", s.dropped)
+	}
+}
+
+func TestAppendObject(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the content of the log, if any, made of components files
+		existing   string
+		components int
+		want       string
+		// rotated is the content expected to be moved aside, if any
+		rotated        string
+		wantComponents string
+	}{
+		{name: "created", want: "b\n"},
+		{name: "appended", existing: "a\n", want: "a\nb\n", wantComponents: "2"},
+		{name: "appended again", existing: "a\n", components: 2, want: "a\nb\n", wantComponents: "3"},
+		{name: "rotated", existing: "a\n", components: maxComposedComponents, want: "b\n", rotated: "a\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			var generation int64
+			if test.existing != "" {
+				m.put("audit.log", []byte(test.existing))
+				o := m.objects["audit.log"]
+				generation = o.generation
+				if test.components > 0 {
+					o.metadata = map[string]string{componentsMetadata: strconv.Itoa(test.components)}
+				}
+			}
+
+			if err := appendObject(context.Background(), "bucket", "audit.log", []byte("b\n")); err != nil {
+				t.Fatalf("appendObject() = %v", err)
+			}
+			if got, _ := m.get("audit.log"); string(got) != test.want {
+				t.Errorf("Log = %q, want %q", got, test.want)
+			}
+			if got := m.objects["audit.log"].metadata[componentsMetadata]; got != test.wantComponents {
+				t.Errorf("Log components = %q, want %q", got, test.wantComponents)
+			}
+			rotated, ok := m.get(fmt.Sprintf("audit.log.%d", generation))
+			if test.rotated == "" && ok {
+				t.Errorf("Log was rotated to %q", rotated)
+			}
+			if test.rotated != "" && string(rotated) != test.rotated {
+				t.Errorf("Rotated log = %q, want %q", rotated, test.rotated)
+			}
+		})
+	}
+}
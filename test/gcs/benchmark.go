@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// benchmark.go defines functions measuring gcs performance
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"time"
+)
+
+// Benchmark uploads a random file of sizeBytes to the bucket, downloads it back, deletes it,
+// and returns how long the upload and the download took. Random content keeps compression
+// along the way from skewing the timings, and it's streamed so any size can be probed.
+// Small sizes mostly measure latency, large ones throughput.
+func Benchmark(ctx context.Context, bucketName string, sizeBytes int64) (uploadDur, downloadDur time.Duration, err error) {
+	if sizeBytes < 0 {
+		return 0, 0, fmt.Errorf("invalid benchmark size %d", sizeBytes)
+	}
+	temps := newTempObjects(bucketName)
+	defer temps.cleanup()
+	handle, err := createDestinationObject(bucketName, temps.add(tempPath("gcs-benchmark", "probe")))
+	if err != nil {
+		return 0, 0, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+
+	start := time.Now()
+	w := newProfiledWriter(ctx, handle)
+	w.ContentType = "application/octet-stream"
+	if _, err := io.CopyN(w, rand.New(rand.NewSource(start.UnixNano())), sizeBytes); err != nil {
+		w.CloseWithError(err)
+		return 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, err
+	}
+	uploadDur = time.Since(start)
+
+	start = time.Now()
+	r, err := handle.NewReader(ctx)
+	if err != nil {
+		return uploadDur, 0, err
+	}
+	defer r.Close()
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return uploadDur, 0, err
+	}
+	return uploadDur, time.Since(start), nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// bucket.go defines functions inspecting and provisioning gcs buckets
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// BucketConfig is the expected configuration of a bucket, nil or empty fields aren't checked
+type BucketConfig struct {
+	VersioningEnabled *bool
+	// StorageClass is the default storage class, e.g. "STANDARD"
+	StorageClass string
+	Location     string
+	// RetentionPeriod is the minimum retention of objects, 0 expects no retention policy
+	RetentionPeriod *time.Duration
+	RetentionLocked *bool
+	RequesterPays   *bool
+	// UniformAccess is whether uniform bucket-level access is enabled
+	UniformAccess *bool
+}
+
+// VerifyBucketConfig reads the bucket attrs and returns a description of each setting
+// not matching want, so pipelines can refuse to run against misconfigured buckets.
+func VerifyBucketConfig(ctx context.Context, bucketName string, want BucketConfig) (diffs []string, err error) {
+	attrs, err := client.Bucket(bucketName).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	diff := func(setting string, want, got interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s: want %v, got %v", setting, want, got))
+	}
+
+	if want.VersioningEnabled != nil && *want.VersioningEnabled != attrs.VersioningEnabled {
+		diff("versioning enabled", *want.VersioningEnabled, attrs.VersioningEnabled)
+	}
+	if want.StorageClass != "" && !strings.EqualFold(want.StorageClass, attrs.StorageClass) {
+		diff("storage class", want.StorageClass, attrs.StorageClass)
+	}
+	if want.Location != "" && !strings.EqualFold(want.Location, attrs.Location) {
+		diff("location", want.Location, attrs.Location)
+	}
+	var period time.Duration
+	locked := false
+	if attrs.RetentionPolicy != nil {
+		period = attrs.RetentionPolicy.RetentionPeriod
+		locked = attrs.RetentionPolicy.IsLocked
+	}
+	if want.RetentionPeriod != nil && *want.RetentionPeriod != period {
+		diff("retention period", *want.RetentionPeriod, period)
+	}
+	if want.RetentionLocked != nil && *want.RetentionLocked != locked {
+		diff("retention policy locked", *want.RetentionLocked, locked)
+	}
+	if want.RequesterPays != nil && *want.RequesterPays != attrs.RequesterPays {
+		diff("requester pays", *want.RequesterPays, attrs.RequesterPays)
+	}
+	if want.UniformAccess != nil {
+		uniform, err := hasUniformAccess(ctx, bucketName)
+		if err != nil {
+			return diffs, err
+		}
+		if *want.UniformAccess != uniform {
+			diff("uniform bucket-level access", *want.UniformAccess, uniform)
+		}
+	}
+	return diffs, nil
+}
+
+// CopyEnsureBucket is Copy, but first creates dstBucket in dstProject with bucketAttrs, which may
+// be nil for defaults, if it doesn't exist yet. A bucket created concurrently by someone else
+// is used as is, its attrs may then differ from bucketAttrs.
+func CopyEnsureBucket(ctx context.Context, srcBucket, srcPath, dstProject, dstBucket, dstPath string, bucketAttrs *storage.BucketAttrs) error {
+	if err := ensureBucket(ctx, dstProject, dstBucket, bucketAttrs); err != nil {
+		return err
+	}
+	return Copy(ctx, srcBucket, srcPath, dstBucket, dstPath)
+}
+
+// ensureBucket creates the bucket unless it already exists
+func ensureBucket(ctx context.Context, project, bucketName string, attrs *storage.BucketAttrs) error {
+	bucket := client.Bucket(bucketName)
+	_, err := bucket.Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if err != storage.ErrBucketNotExist {
+		return err
+	}
+	err = bucket.Create(ctx, project, attrs)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed creating bucket %q: %v", bucketName, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// budget.go defines byte budgets capping how much is read from gcs across calls
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrBudgetExceeded is returned by reads going over the ByteBudget of their context
+var ErrBudgetExceeded = errors.New("gcs: read byte budget exceeded")
+
+// ByteBudget is a number of bytes shared by all reads made with a context carrying it,
+// see WithByteBudget. It's safe for concurrent use.
+type ByteBudget struct {
+	mu        sync.Mutex
+	remaining int64
+}
+
+// budgetKey is the context key of the ByteBudget
+type budgetKey struct{}
+
+// NewByteBudget creates a ByteBudget of n bytes
+func NewByteBudget(n int64) *ByteBudget {
+	return &ByteBudget{remaining: n}
+}
+
+// Remaining returns the number of bytes left in the budget
+func (b *ByteBudget) Remaining() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining
+}
+
+// take reserves up to n bytes, returning how many were granted
+func (b *ByteBudget) take(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+	}
+	b.remaining -= int64(n)
+	return n
+}
+
+// refund gives back unused reserved bytes
+func (b *ByteBudget) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining += int64(n)
+}
+
+// WithByteBudget returns a copy of ctx carrying b, so that the functions reading file content made
+// with it, like Read, Download, GrepPrefix or NewReaderAt reads, fail with ErrBudgetExceeded once
+// they read more than b's bytes in total.
+// Contexts without a budget read without limit.
+func WithByteBudget(ctx context.Context, b *ByteBudget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// limitByBudget wraps r so that it consumes the ByteBudget of ctx, if any
+func limitByBudget(ctx context.Context, r io.Reader) io.Reader {
+	b, ok := ctx.Value(budgetKey{}).(*ByteBudget)
+	if !ok {
+		return r
+	}
+	return &budgetReader{r: r, budget: b}
+}
+
+// budgetReader is a Reader failing once its budget is exhausted
+type budgetReader struct {
+	r      io.Reader
+	budget *ByteBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	granted := br.budget.take(len(p))
+	if granted == 0 {
+		// Content ending right at the budget shouldn't fail, so check for EOF first.
+		var probe [1]byte
+		if n, err := br.r.Read(probe[:]); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, ErrBudgetExceeded
+	}
+	n, err := br.r.Read(p[:granted])
+	br.budget.refund(granted - n)
+	return n, err
+}
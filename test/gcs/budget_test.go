@@ -0,0 +1,184 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestBudgetReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		budget  int64
+		want    string
+		wantErr error
+		left    int64
+	}{
+		{"within budget", "hello", 10, "hello", nil, 5},
+		// Content ending right at the budget doesn't exceed it.
+		{"exactly the budget", "hello", 5, "hello", nil, 0},
+		{"exceeds budget", "hello world", 5, "hello", ErrBudgetExceeded, 0},
+		{"no budget", "hello", 0, "", ErrBudgetExceeded, 0},
+		{"empty", "", 0, "", nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewByteBudget(test.budget)
+			ctx := WithByteBudget(context.Background(), b)
+			got, err := ioutil.ReadAll(limitByBudget(ctx, strings.NewReader(test.content)))
+			if err != test.wantErr {
+				t.Errorf("ReadAll() error = %v, want %v", err, test.wantErr)
+			}
+			if string(got) != test.want {
+				t.Errorf("ReadAll() = %q, want %q", got, test.want)
+			}
+			if left := b.Remaining(); left != test.left {
+				t.Errorf("Remaining() = %d, want %d", left, test.left)
+			}
+		})
+	}
+}
+
+func TestBudgetReaderShared(t *testing.T) {
+	// Without a budget in the context, the reader is returned as is.
+	r := strings.NewReader("hello")
+	if got := limitByBudget(context.Background(), r); got != r {
+		t.Errorf("limitByBudget() without budget = %T, want the reader itself", got)
+	}
+
+	const readers, size = 8, 1000
+	b := NewByteBudget(readers * size / 2)
+	ctx := WithByteBudget(context.Background(), b)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int
+	)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, _ := ioutil.ReadAll(limitByBudget(ctx, bytes.NewReader(make([]byte, size))))
+			mu.Lock()
+			total += len(got)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	// Concurrent reads never share out more than the budget, and don't leak any of it.
+	if total != readers*size/2 {
+		t.Errorf("Concurrent readers read %d bytes, want %d", total, readers*size/2)
+	}
+	if left := b.Remaining(); left != 0 {
+		t.Errorf("Remaining() = %d, want 0", left)
+	}
+}
+
+func TestByteBudgetEnforced(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(ctx context.Context) error
+	}{
+		{"GrepObject", func(ctx context.Context) error {
+			_, err := GrepObject(ctx, "bucket", "file.json", regexp.MustCompile("x"), ioutil.Discard)
+			return err
+		}},
+		{"ProcessPrefix", func(ctx context.Context) error {
+			return ProcessPrefix(ctx, "bucket", "", 1, func(_ *storage.ObjectAttrs, r io.Reader) error {
+				_, err := ioutil.ReadAll(r)
+				return err
+			})
+		}},
+		{"Diff", func(ctx context.Context) error {
+			return Diff(ctx, "bucket", "file.json", "bucket", "file.json", ioutil.Discard)
+		}},
+		{"KVGet", func(ctx context.Context) error {
+			_, _, err := KVGet(ctx, "bucket", "file.json", "key")
+			return err
+		}},
+		{"isValidJSON", func(ctx context.Context) error {
+			_, err := isValidJSON(ctx, "bucket", "file.json")
+			return err
+		}},
+		{"CachingClient", func(ctx context.Context) error {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			c, err := NewCachingClient(dir, 0)
+			if err != nil {
+				return err
+			}
+			_, err = c.Read(ctx, "bucket", "file.json")
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			m.put("file.json", []byte(`{"key": "a value longer than the budget"}`))
+
+			ctx := WithByteBudget(context.Background(), NewByteBudget(4))
+			if err := test.read(ctx); err == nil || !strings.Contains(err.Error(), ErrBudgetExceeded.Error()) {
+				t.Errorf("%s() = %v, want %v", test.name, err, ErrBudgetExceeded)
+			}
+		})
+	}
+}
+
+func TestByteBudgetTake(t *testing.T) {
+	const takers, n = 10, 100
+	b := NewByteBudget(takers * n / 2)
+	var (
+		wg      sync.WaitGroup
+		granted = make([]int, takers)
+	)
+	for i := 0; i < takers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			granted[i] = b.take(n)
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for _, g := range granted {
+		if g < 0 || g > n {
+			t.Errorf("take(%d) granted %d", n, g)
+		}
+		total += g
+	}
+	if total != takers*n/2 {
+		t.Errorf("Concurrent takes granted %d bytes, want %d", total, takers*n/2)
+	}
+	if left := b.Remaining(); left != 0 {
+		t.Errorf("Remaining() = %d, want 0", left)
+	}
+	b.refund(n)
+	if left := b.Remaining(); left != n {
+		t.Errorf("Remaining() after refund = %d, want %d", left, n)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// builds.go defines functions for CI layouts storing builds as numbered directories
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// dirPrefix turns a directory path into the prefix listing its children
+func dirPrefix(dir string) string {
+	dir = strings.TrimRight(dir, " /")
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// LatestBuild returns the highest build number among the direct subdirectories of prefix,
+// like "builds/124/" under "builds". Subdirectories not named by an integer are ignored.
+func LatestBuild(ctx context.Context, bucketName, prefix string) (int, error) {
+	latest, found := 0, false
+	err := iterateObjects(ctx, bucketName, dirPrefix(prefix), "/", func(attrs *storage.ObjectAttrs) error {
+		if attrs.Prefix == "" {
+			return nil
+		}
+		build, err := strconv.Atoi(path.Base(attrs.Prefix))
+		if err != nil {
+			return nil
+		}
+		if !found || build > latest {
+			latest, found = build, true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("no build found under gs://%s/%s", bucketName, prefix)
+	}
+	return latest, nil
+}
+
+// BuildInfo summarizes a build directory
+type BuildInfo struct {
+	// ID is the name of the build directory
+	ID string
+	// Started is the creation time of the oldest file of the build
+	Started time.Time
+	// Finished is the update time of the newest file of the build
+	Finished time.Time
+	// TotalBytes is the total size of the files of the build
+	TotalBytes int64
+}
+
+// BuildHistory summarizes each direct subdirectory of prefix as a build, most recently started
+// first, from the times and sizes of all files under it. It lists prefix recursively once.
+// Files directly under prefix don't belong to any build and are ignored.
+func BuildHistory(ctx context.Context, bucketName, prefix string) ([]BuildInfo, error) {
+	prefix = dirPrefix(prefix)
+	builds := make(map[string]*BuildInfo)
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		rel := strings.TrimPrefix(attrs.Name, prefix)
+		i := strings.Index(rel, "/")
+		if i <= 0 {
+			return nil
+		}
+		id := rel[:i]
+		b, ok := builds[id]
+		if !ok {
+			b = &BuildInfo{ID: id, Started: attrs.Created, Finished: attrs.Updated}
+			builds[id] = b
+		}
+		if attrs.Created.Before(b.Started) {
+			b.Started = attrs.Created
+		}
+		if attrs.Updated.After(b.Finished) {
+			b.Finished = attrs.Updated
+		}
+		b.TotalBytes += attrs.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := make([]BuildInfo, 0, len(builds))
+	for _, b := range builds {
+		history = append(history, *b)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].Started.Equal(history[j].Started) {
+			return history[i].Started.After(history[j].Started)
+		}
+		return history[i].ID > history[j].ID
+	})
+	return history, nil
+}
+
+// PathBuilder returns the path of a file of a CI build, given its path relative to the build directory
+type PathBuilder func(job string, build int, file string) string
+
+// DefaultPathBuilder lays builds out as prow does for periodic and postsubmit jobs,
+// "logs/<job>/<build>/<file>"
+func DefaultPathBuilder(job string, build int, file string) string {
+	return path.Join("logs", job, strconv.Itoa(build), file)
+}
+
+var pathBuilder PathBuilder = DefaultPathBuilder
+
+// SetPathBuilder sets how ArtifactURL lays out build files, DefaultPathBuilder by default.
+// Like Authenticate, it should be called before any other function.
+func SetPathBuilder(builder PathBuilder) {
+	pathBuilder = builder
+}
+
+// ArtifactURL returns the HTTPS URL of file of the given build of job, as laid out by the
+// path builder, e.g. "artifacts/junit.xml". No request is made.
+func ArtifactURL(bucketName, job string, build int, file string) string {
+	return PublicURL(bucketName, pathBuilder(job, build, file))
+}
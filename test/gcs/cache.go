@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cache.go defines clients caching gcs files on local disk or in memory
+
+package gcs
+
+import (
+	lru "container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CachingClient reads gcs files through a local disk cache, keyed by path and generation.
+// Every read still makes an Attrs call to get the current generation, but the content is only
+// downloaded when that generation isn't cached yet. It's meant for hot, rarely changing files.
+type CachingClient struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex
+}
+
+// NewCachingClient creates a CachingClient storing files under dir, evicting the least
+// recently read files once the cache exceeds maxBytes. A maxBytes of 0 means unbounded.
+func NewCachingClient(dir string, maxBytes int64) (*CachingClient, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CachingClient{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Read reads the specified file, from the cache if its current generation is cached
+func (c *CachingClient) Read(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := c.key(bucketName, filePath)
+	cachePath := filepath.Join(c.dir, fmt.Sprintf("%s-%d", key, attrs.Generation))
+
+	c.mu.Lock()
+	contents, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		// The modification time tracks the last read, for eviction.
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+	}
+	c.mu.Unlock()
+	if err == nil {
+		return contents, nil
+	}
+
+	r, err := handle.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	contents, err = ioutil.ReadAll(limitByBudget(ctx, r))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store(key, cachePath, contents); err != nil {
+		// The cache is an optimization, failing to fill it doesn't fail the read.
+		return contents, nil
+	}
+	c.evict()
+	return contents, nil
+}
+
+// key derives the cache file name prefix of a gcs file
+func (c *CachingClient) key(bucketName, filePath string) string {
+	sum := sha256.Sum256([]byte(bucketName + "/" + objectName(filePath)))
+	return hex.EncodeToString(sum[:])
+}
+
+// store writes contents to cachePath, replacing older generations of the same file
+func (c *CachingClient) store(key, cachePath string, contents []byte) error {
+	older, _ := filepath.Glob(filepath.Join(c.dir, key+"-*"))
+	for _, p := range older {
+		os.Remove(p)
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath)
+}
+
+// evict removes the least recently read files until the cache fits in maxBytes
+func (c *CachingClient) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, info := range infos {
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= c.maxBytes {
+			return
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+}
+
+// ContentCache reads gcs files through an in-memory cache keyed by content, their size and
+// CRC32C, so that files with identical content under different paths are only downloaded once.
+// Every read still makes an Attrs call to get the current checksum, so changed files are never
+// served stale. It's meant for workloads reading many duplicated files. It's safe for concurrent use.
+type ContentCache struct {
+	maxBytes int64
+	mu       sync.Mutex
+	size     int64
+	// order holds *contentEntry, most recently read first
+	order   *lru.List
+	entries map[contentKey]*lru.Element
+}
+
+// contentKey identifies a file content
+type contentKey struct {
+	size   int64
+	crc32c uint32
+}
+
+// contentEntry is a cached file content
+type contentEntry struct {
+	key      contentKey
+	contents []byte
+}
+
+// NewContentCache creates a ContentCache holding up to maxBytes of file contents, evicting the
+// least recently read ones beyond that. Files larger than maxBytes are never cached.
+func NewContentCache(maxBytes int64) *ContentCache {
+	return &ContentCache{
+		maxBytes: maxBytes,
+		order:    lru.New(),
+		entries:  make(map[contentKey]*lru.Element),
+	}
+}
+
+// Read reads the specified file, from the cache if a file with the same content was read before
+func (c *ContentCache) Read(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := contentKey{size: attrs.Size, crc32c: attrs.CRC32C}
+	if contents, ok := c.get(key); ok {
+		return contents, nil
+	}
+	contents, err := readGeneration(ctx, handle, attrs.Generation)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, contents)
+	return contents, nil
+}
+
+// get returns a copy of the cached content of key, so that callers can't change the cache
+func (c *ContentCache) get(key contentKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*contentEntry).contents...), true
+}
+
+// put caches a copy of contents under key, evicting the least recently read contents to fit it
+func (c *ContentCache) put(key contentKey, contents []byte) {
+	size := int64(len(contents))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*contentEntry)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.contents))
+	}
+	c.entries[key] = c.order.PushFront(&contentEntry{key: key, contents: append([]byte(nil), contents...)})
+	c.size += size
+}
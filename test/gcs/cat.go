@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// cat.go defines functions printing gcs files, for command line tools
+
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+)
+
+// binarySniffSize is the number of leading bytes Cat looks at to detect binary content
+const binarySniffSize = 512
+
+// Cat streams the content of the specified file to w, e.g. os.Stdout, decompressing it first if
+// it's gzip compressed. If the content looks binary, having NUL bytes among its first bytes, a
+// warning is logged before streaming, as printing it may garble a terminal.
+func Cat(ctx context.Context, bucketName, filePath string, w io.Writer) error {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src, err := maybeGunzip(limitByBudget(ctx, f))
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(src, binarySniffSize)
+	head, err := br.Peek(binarySniffSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		log.Printf("Warning: %q looks like a binary file", filePath)
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// checksum.go defines functions finding and repairing gcs files without checksums
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// ObjectsMissingChecksum lists all files under prefix and returns the ones without MD5 or
+// CRC32C checksum, typically composite files, which only have a CRC32C, and files written by
+// tools bypassing the usual upload APIs. Checksums come with the listing, so no per-object
+// Attrs calls are made. Empty files have a CRC32C of 0 and aren't reported for it.
+func ObjectsMissingChecksum(ctx context.Context, bucketName, prefix string) ([]string, error) {
+	var missing []string
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if len(attrs.MD5) == 0 || (attrs.CRC32C == 0 && attrs.Size > 0) {
+			missing = append(missing, attrs.Name)
+		}
+		return nil
+	})
+	return missing, err
+}
+
+// RepairChecksums re-uploads each of filePaths onto itself, so gcs computes both its checksums,
+// and returns the number of files repaired. A server side rewrite wouldn't do, as it keeps the
+// checksums of the source. The content is streamed as stored, compressed files stay compressed,
+// and editable attributes are kept. Files changed since they were read are skipped, as the
+// new content needs checking again.
+func RepairChecksums(ctx context.Context, bucketName string, filePaths []string) (int, error) {
+	repaired := 0
+	for _, filePath := range filePaths {
+		err := repairChecksum(ctx, bucketName, filePath)
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return repaired, fmt.Errorf("failed repairing %q: %v", filePath, err)
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// repairChecksum re-uploads a single file onto itself
+func repairChecksum(ctx context.Context, bucketName, filePath string) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	src, err := handle.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := newProfiledWriter(ctx, handle.If(storage.Conditions{GenerationMatch: attrs.Generation}))
+	keepEditableAttrs(&dst.ObjectAttrs, attrs)
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.CloseWithError(err)
+		return err
+	}
+	return dst.Close()
+}
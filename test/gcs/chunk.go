@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// chunk.go defines content-defined chunking of gcs files, for chunk-level deduplication
+
+package gcs
+
+import (
+	"bufio"
+	"context"
+	"hash/fnv"
+	"io"
+)
+
+const (
+	// chunkWindow is the number of trailing bytes the rolling hash covers
+	chunkWindow = 64
+	// chunkMinSize and chunkMaxSize bound the size of chunks
+	chunkMinSize = 2 * 1024
+	chunkMaxSize = 64 * 1024
+	// chunkMask selects the rolling hash bits that must be zero at a boundary, for 8KiB chunks on average
+	chunkMask = 8*1024 - 1
+	// chunkPrime is the base of the polynomial rolling hash
+	chunkPrime = 1099511628211
+)
+
+// chunkPrimePow is chunkPrime^chunkWindow, the weight of the byte leaving the window
+var chunkPrimePow = func() uint64 {
+	p := uint64(1)
+	for i := 0; i < chunkWindow; i++ {
+		p *= chunkPrime
+	}
+	return p
+}()
+
+// ChunkObject streams the specified file and splits it into content-defined chunks, calling fn
+// with each chunk and its FNV-1a 64 bit hash, stopping at the first error fn returns.
+// Boundaries are placed where a Rabin-Karp rolling hash of the last 64 bytes matches a pattern,
+// so they only depend on nearby content: an insertion changes the chunks around it, not all the
+// following ones. Chunks are 8KiB on average, between 2KiB and 64KiB, except the last one
+// which may be smaller. The chunk slice is reused, fn must copy it to keep it.
+func ChunkObject(ctx context.Context, bucketName, filePath string, fn func(chunk []byte, hash uint64) error) error {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(limitByBudget(ctx, f))
+	chunk := make([]byte, 0, chunkMaxSize)
+	emit := func() error {
+		h := fnv.New64a()
+		h.Write(chunk)
+		err := fn(chunk, h.Sum64())
+		chunk = chunk[:0]
+		return err
+	}
+	var rolling uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, b)
+		rolling = rolling*chunkPrime + uint64(b)
+		if len(chunk) > chunkWindow {
+			rolling -= uint64(chunk[len(chunk)-chunkWindow-1]) * chunkPrimePow
+		}
+		if (len(chunk) >= chunkMinSize && rolling&chunkMask == 0) || len(chunk) == chunkMaxSize {
+			if err := emit(); err != nil {
+				return err
+			}
+			rolling = 0
+		}
+	}
+	if len(chunk) > 0 {
+		return emit()
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestChunkObject(t *testing.T) {
+	random := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name string
+		data []byte
+		// sizes are the expected chunk sizes, nil to only check the bounds
+		sizes []int
+	}{
+		{name: "empty", data: nil, sizes: []int{}},
+		{name: "single byte", data: []byte{1}, sizes: []int{1}},
+		{name: "under the minimum size", data: random[:chunkMinSize-1], sizes: []int{chunkMinSize - 1}},
+		// The rolling hash of zeros is zero, so every chunk ends as soon as it's allowed to.
+		{name: "zeros", data: make([]byte, 2*chunkMinSize+1), sizes: []int{chunkMinSize, chunkMinSize, 1}},
+		{name: "random", data: random},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			m.put("file", test.data)
+
+			var got []byte
+			sizes := []int{}
+			err := ChunkObject(context.Background(), "bucket", "file", func(chunk []byte, hash uint64) error {
+				h := fnv.New64a()
+				h.Write(chunk)
+				if hash != h.Sum64() {
+					t.Errorf("Chunk %d has hash %x, want %x", len(sizes), hash, h.Sum64())
+				}
+				got = append(got, chunk...)
+				sizes = append(sizes, len(chunk))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ChunkObject() = %v", err)
+			}
+			if !bytes.Equal(got, test.data) {
+				t.Errorf("Chunks don't add up to the file")
+			}
+			if test.sizes != nil && !reflect.DeepEqual(sizes, test.sizes) {
+				t.Errorf("Chunk sizes = %v, want %v", sizes, test.sizes)
+			}
+			for i, size := range sizes {
+				if size > chunkMaxSize || (size < chunkMinSize && i < len(sizes)-1) {
+					t.Errorf("Chunk %d has %d bytes, want between %d and %d", i, size, chunkMinSize, chunkMaxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkObjectLocality(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+
+	hashes := func(data []byte) map[uint64]bool {
+		m := newMemGCS(t)
+		defer m.Close()
+		m.put("file", data)
+		seen := make(map[uint64]bool)
+		err := ChunkObject(context.Background(), "bucket", "file", func(_ []byte, hash uint64) error {
+			seen[hash] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ChunkObject() = %v", err)
+		}
+		return seen
+	}
+	before, after := hashes(data), hashes(edited)
+	// An insertion only changes the chunks around it.
+	changed := 0
+	for hash := range before {
+		if !after[hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("Inserting near the start changed %d of %d chunks, want at most 2", changed, len(before))
+	}
+}
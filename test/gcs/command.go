@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// command.go defines functions connecting gcs objects with external commands
+
+package gcs
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// DownloadOption configures DownloadToCommand
+type DownloadOption func(*downloadOptions)
+
+// downloadOptions holds the settings of a single DownloadToCommand call
+type downloadOptions struct {
+	gunzip bool
+}
+
+// WithGunzip decompresses the file content first if it's gzip compressed, content that isn't
+// is passed on as is.
+func WithGunzip() DownloadOption {
+	return func(o *downloadOptions) {
+		o.gunzip = true
+	}
+}
+
+// UploadCommandOutput runs cmd and streams its combined stdout and stderr to gcs dstPath as it runs,
+// so the output is never buffered on local disk. cmd's Stdout and Stderr are overwritten.
+// The object is finalized once the command exits, even if it failed, and the command's error
+// takes precedence over the upload error.
+func UploadCommandOutput(ctx context.Context, bucketName, dstPath string, cmd *exec.Cmd) error {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	dst := newProfiledWriter(ctx, handle)
+	dst.ContentType = "text/plain"
+	// Using the same writer for both makes exec share a single pipe,
+	// so writes to dst never happen concurrently.
+	cmd.Stdout = dst
+	cmd.Stderr = dst
+	runErr := cmd.Run()
+	closeErr := dst.Close()
+	if runErr != nil {
+		return runErr
+	}
+	return closeErr
+}
+
+// DownloadToCommand runs cmd with the content of the specified file streamed to its stdin,
+// so it's never staged on local disk, and returns the command's error as is, e.g. an
+// *exec.ExitError. cmd's Stdin is overwritten. Commands exiting before reading all their
+// input aren't an error.
+func DownloadToCommand(ctx context.Context, bucketName, filePath string, cmd *exec.Cmd, opts ...DownloadOption) error {
+	var o downloadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var src io.Reader = limitByBudget(ctx, f)
+	if o.gunzip {
+		if src, err = maybeGunzip(src); err != nil {
+			return err
+		}
+	}
+	cmd.Stdin = src
+	return cmd.Run()
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// compress.go defines helpers handling compressed gcs files
+
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// gzipMagic is the header every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeGunzip returns a reader decompressing r if it's a gzip stream, or reading r as is otherwise.
+// Detection looks at the content rather than the file name or Content-Encoding, as gcs already
+// decompresses files stored with "Content-Encoding: gzip" when serving them.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// Decompressor wraps a compressed stream into a reader of its decompressed content
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+// decompressors maps content encodings, like "gzip", and lower case file extensions,
+// like ".gz", to their Decompressor
+var decompressors = map[string]Decompressor{
+	"gzip": gunzip,
+	".gz":  gunzip,
+}
+
+// gunzip is the gzip Decompressor
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// Compressor wraps a writer into a writer compressing to it, closing it must flush the compressed
+// stream without closing w
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// compressors maps content encodings, like "gzip", to their Compressor
+var compressors = map[string]Compressor{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+}
+
+// identityCodec is the codec name of uncompressed content
+const identityCodec = "identity"
+
+// RegisterCompressor makes Transcode use c for the codec, an encoding like "zstd". It replaces
+// any Compressor previously registered for it, gzip is registered by default. Transcoding from
+// the codec needs a Decompressor registered for it too, see RegisterDecompressor.
+// Like Authenticate, it should be called before any other function.
+func RegisterCompressor(codec string, c Compressor) {
+	compressors[strings.ToLower(codec)] = c
+}
+
+// RegisterDecompressor makes ReadAuto use d for files stored with Content-Encoding key, when key
+// is an encoding like "zstd", or for files named with extension key, when key starts with a dot
+// like ".zst". It replaces any Decompressor previously registered for key, gzip is registered
+// by default. Like Authenticate, it should be called before any other function.
+func RegisterDecompressor(key string, d Decompressor) {
+	decompressors[strings.ToLower(key)] = d
+}
+
+// ReadAuto reads the specified file and decompresses it with the Decompressor registered for its
+// content encoding or, if there's none, for its file extension. Files matching no Decompressor
+// are returned raw.
+func ReadAuto(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := decompressors[strings.ToLower(attrs.ContentEncoding)]
+	if !ok || attrs.ContentEncoding == "" {
+		d, ok = decompressors[strings.ToLower(path.Ext(filePath))]
+	}
+	// Reading compressed keeps gcs from decompressing gzip encoded files itself.
+	f, err := handle.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = limitByBudget(ctx, f)
+	if ok {
+		if r, err = d(r); err != nil {
+			return nil, fmt.Errorf("cannot decompress %q: %v", filePath, err)
+		}
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %q: %v", filePath, err)
+	}
+	return contents, nil
+}
+
+// tempPath returns a unique path next to filePath for a temporary file
+func tempPath(filePath, purpose string) string {
+	return fmt.Sprintf("%s.%s-%d.tmp", filePath, purpose, time.Now().UnixNano())
+}
+
+// CompressInPlace replaces the file with a gzip compressed copy stored with "Content-Encoding: gzip",
+// so gcs still serves it decompressed to clients not accepting gzip, and returns the bytes saved.
+// The compressed copy is streamed to a temporary file which then replaces the original, unless
+// the original changed meanwhile. Files already gzip encoded or named .gz or .tgz are skipped,
+// as are files compression doesn't make smaller.
+func CompressInPlace(ctx context.Context, bucketName, filePath string) (savedBytes int64, err error) {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".gz", ".tgz":
+		return 0, nil
+	}
+	if attrs.ContentEncoding == "gzip" {
+		return 0, nil
+	}
+
+	src, err := handle.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	temps := newTempObjects(bucketName)
+	defer temps.cleanup()
+	tmp, err := createDestinationObject(bucketName, temps.add(tempPath(filePath, "gzip")))
+	if err != nil {
+		return 0, err
+	}
+	w := newProfiledWriter(ctx, tmp)
+	keepEditableAttrs(&w.ObjectAttrs, attrs)
+	w.ContentEncoding = "gzip"
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, src); err != nil {
+		w.CloseWithError(err)
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		w.CloseWithError(err)
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	compressed := w.Attrs()
+	if compressed.Size >= attrs.Size {
+		return 0, nil
+	}
+	swap := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).CopierFrom(tmp)
+	err = withRetry(ctx, bucketName, func() error {
+		_, err := swap.Run(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size - compressed.Size, nil
+}
+
+// Transcode streams srcPath, decompressed with fromCodec, into dstPath, compressed with toCodec,
+// without staging it locally. Codecs are encodings, like "gzip" or a codec registered with
+// RegisterCompressor and RegisterDecompressor, such as "zstd", or "identity" for uncompressed
+// content. A source stored with Content-Encoding fromCodec gets a destination stored with
+// Content-Encoding toCodec, keeping its content type; otherwise dstPath's extension, like ".zst",
+// tells the content type. Other editable attributes are kept.
+func Transcode(ctx context.Context, bucketName, srcPath, dstPath, fromCodec, toCodec string) error {
+	dst, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	fromCodec, toCodec = strings.ToLower(fromCodec), strings.ToLower(toCodec)
+	decompress, ok := decompressors[fromCodec]
+	if fromCodec == identityCodec {
+		decompress, ok = func(r io.Reader) (io.Reader, error) { return r, nil }, true
+	}
+	if !ok {
+		return fmt.Errorf("no decompressor registered for codec %q", fromCodec)
+	}
+	compress, ok := compressors[toCodec]
+	if toCodec == identityCodec {
+		compress, ok = func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }, true
+	}
+	if !ok {
+		return fmt.Errorf("no compressor registered for codec %q", toCodec)
+	}
+
+	handle := createStorageObject(bucketName, srcPath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	// Reading compressed keeps gcs from decompressing gzip encoded files itself.
+	src, err := handle.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, err := decompress(limitByBudget(ctx, src))
+	if err != nil {
+		return fmt.Errorf("cannot decompress %q as %s: %v", srcPath, fromCodec, err)
+	}
+
+	w := newProfiledWriter(ctx, dst)
+	keepEditableAttrs(&w.ObjectAttrs, attrs)
+	w.ContentEncoding = ""
+	if attrs.ContentEncoding != "" && strings.EqualFold(attrs.ContentEncoding, fromCodec) {
+		if toCodec != identityCodec {
+			w.ContentEncoding = toCodec
+		}
+	} else {
+		w.ContentType = inferContentType(dstPath)
+	}
+	cw, err := compress(w)
+	if err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		w.CloseWithError(err)
+		return fmt.Errorf("failed transcoding %q: %v", srcPath, err)
+	}
+	if err := cw.Close(); err != nil {
+		w.CloseWithError(err)
+		return fmt.Errorf("failed transcoding %q: %v", srcPath, err)
+	}
+	return w.Close()
+}
+
+// nopWriteCloser is a WriteCloser whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
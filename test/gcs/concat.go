@@ -0,0 +1,276 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// concat.go defines functions concatenating many gcs files into a single local or gcs file
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// maxComposeSources is the maximum number of source files of a gcs compose request
+const maxComposeSources = 32
+
+// ConcatOption configures DownloadConcatenated
+type ConcatOption func(*concatOptions)
+
+// concatOptions holds the settings of a single DownloadConcatenated call
+type concatOptions struct {
+	separator func(path string) []byte
+}
+
+// WithSeparator makes DownloadConcatenated write separator(path) before the content of each
+// file, e.g. a "=== path ===\n" header telling where each file starts in the combined output.
+func WithSeparator(separator func(path string) []byte) ConcatOption {
+	return func(o *concatOptions) {
+		o.separator = separator
+	}
+}
+
+// DownloadConcatenated downloads all files under prefix, in lexicographic order, one after the
+// other into the local file dstPath, replacing it if it exists. Files are streamed, so neither
+// one file nor the combined output is held in memory.
+func DownloadConcatenated(ctx context.Context, bucketName, prefix, dstPath string, opts ...ConcatOption) error {
+	var o concatOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if strings.HasSuffix(attrs.Name, "/") {
+			return nil
+		}
+		if o.separator != nil {
+			if _, err := dst.Write(o.separator(attrs.Name)); err != nil {
+				return err
+			}
+		}
+		src, err := createStorageObject(bucketName, attrs.Name).Generation(attrs.Generation).NewReader(ctx)
+		if err != nil {
+			return fmt.Errorf("failed downloading %q: %v", attrs.Name, err)
+		}
+		defer src.Close()
+		if _, err := io.Copy(dst, limitByBudget(ctx, src)); err != nil {
+			return fmt.Errorf("failed downloading %q: %v", attrs.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// ConcatLarge concatenates srcPaths, in order, into dstPath. Up to 32 sources are composed
+// server-side. More sources, or sources gcs refuses to compose, e.g. ones encrypted with customer
+// supplied keys, are streamed through this process instead, into a single upload, which costs
+// downloading and uploading all bytes once. Sources are concatenated as stored, without
+// decompressing gzip encoded ones. The destination size is checked against the sum of the source
+// sizes, and a mismatching destination is deleted.
+func ConcatLarge(ctx context.Context, bucketName string, srcPaths []string, dstPath string) error {
+	if len(srcPaths) == 0 {
+		return fmt.Errorf("no source to concatenate into %q", dstPath)
+	}
+	dst, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	// Pinning the generations makes the size check immune to concurrent writes of the sources.
+	srcs := make([]*storage.ObjectHandle, len(srcPaths))
+	var total int64
+	var first *storage.ObjectAttrs
+	for i, p := range srcPaths {
+		handle := createStorageObject(bucketName, p)
+		attrs, err := handle.Attrs(ctx)
+		if err != nil {
+			return fmt.Errorf("failed reading attrs of %q: %v", p, err)
+		}
+		if first == nil {
+			first = attrs
+		}
+		srcs[i] = handle.Generation(attrs.Generation)
+		total += attrs.Size
+	}
+
+	var written *storage.ObjectAttrs
+	if len(srcs) <= maxComposeSources {
+		composer := dst.ComposerFrom(srcs...)
+		composer.ContentType = first.ContentType
+		err = withRetry(ctx, bucketName, func() error {
+			var err error
+			written, err = composer.Run(ctx)
+			return err
+		})
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusBadRequest {
+			written, err = nil, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if written == nil {
+		if written, err = streamConcat(ctx, dst, srcs, first.ContentType); err != nil {
+			return err
+		}
+	}
+
+	if written.Size == total {
+		return nil
+	}
+	sizeErr := fmt.Errorf("concatenation into %q has %d bytes, sources have %d", dstPath, written.Size, total)
+	if err := dst.If(storage.Conditions{GenerationMatch: written.Generation}).Delete(ctx); err != nil {
+		return fmt.Errorf("%v, and deleting it failed: %v", sizeErr, err)
+	}
+	return sizeErr
+}
+
+// streamConcat uploads the stored content of srcs one after the other to dst
+func streamConcat(ctx context.Context, dst *storage.ObjectHandle, srcs []*storage.ObjectHandle, contentType string) (*storage.ObjectAttrs, error) {
+	w := newProfiledWriter(ctx, dst)
+	w.ContentType = contentType
+	for _, src := range srcs {
+		if err := copyStored(ctx, w, src); err != nil {
+			w.CloseWithError(err)
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+// copyStored writes the stored bytes of src to w
+func copyStored(ctx context.Context, w io.Writer, src *storage.ObjectHandle) error {
+	r, err := src.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed reading %q: %v", relativeName(src.ObjectName()), err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, limitByBudget(ctx, r)); err != nil {
+		return fmt.Errorf("failed reading %q: %v", relativeName(src.ObjectName()), err)
+	}
+	return nil
+}
+
+// MergeJSONArray writes the JSON values of the files under prefix, in lexicographic order, as the
+// elements of a single JSON array to dstPath, and returns the number of values merged. Each file
+// must hold a single JSON value, gzipped or not. Other files are skipped, the returned error
+// lists them, but dstPath is still written with the valid ones. Files are held in memory one at
+// a time, the array is streamed. dstPath itself is skipped if it's under prefix.
+func MergeJSONArray(ctx context.Context, bucketName, prefix, dstPath string) (int, error) {
+	dst, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	w := newProfiledWriter(ctx, dst)
+	w.ContentType = "application/json"
+	merged := 0
+	var invalid []string
+	write := func(b []byte) error {
+		_, err := w.Write(b)
+		return err
+	}
+	err = write([]byte("["))
+	if err == nil {
+		err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+			if attrs.Name == dstPath || strings.HasSuffix(attrs.Name, "/") {
+				return nil
+			}
+			value, err := readJSONValue(ctx, bucketName, attrs)
+			if err != nil {
+				return fmt.Errorf("failed reading %q: %v", attrs.Name, err)
+			}
+			if value == nil {
+				invalid = append(invalid, attrs.Name)
+				return nil
+			}
+			if merged > 0 {
+				if err := write([]byte(",\n")); err != nil {
+					return err
+				}
+			}
+			merged++
+			return write(value)
+		})
+	}
+	if err == nil {
+		err = write([]byte("]\n"))
+	}
+	if err != nil {
+		w.CloseWithError(err)
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return merged, fmt.Errorf("skipped %d files not holding a single JSON value: %s", len(invalid), strings.Join(invalid, ", "))
+	}
+	return merged, nil
+}
+
+// readJSONValue reads the listed generation of the file, returning nil if it isn't a single JSON value
+func readJSONValue(ctx context.Context, bucketName string, attrs *storage.ObjectAttrs) ([]byte, error) {
+	f, err := createStorageObject(bucketName, attrs.Name).Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src := &readErrorRecorder{r: limitByBudget(ctx, f)}
+	r, err := maybeGunzip(src)
+	if err != nil {
+		if src.err != nil {
+			return nil, src.err
+		}
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		if src.err != nil {
+			return nil, src.err
+		}
+		return nil, nil
+	}
+	// Unmarshaling into a RawMessage validates the value and rejects trailing data.
+	var value json.RawMessage
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, nil
+	}
+	return bytes.TrimSpace(value), nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// contenttype.go defines functions inferring and repairing content types of gcs files
+
+package gcs
+
+import (
+	"context"
+	"log"
+	"mime"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// artifactContentTypes are content types of common test artifacts,
+// for extensions that may be missing from the system mime tables.
+var artifactContentTypes = map[string]string{
+	".txt":  "text/plain; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".json": "application/json",
+	".yaml": "text/yaml; charset=utf-8",
+	".yml":  "text/yaml; charset=utf-8",
+	".xml":  "text/xml; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".svg":  "image/svg+xml",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+}
+
+// inferContentType returns the content type for the extension of filePath, or "" if unknown
+func inferContentType(filePath string) string {
+	ext := strings.ToLower(path.Ext(filePath))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := artifactContentTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// sameMediaType compares two content types ignoring their parameters, like charset
+func sameMediaType(a, b string) bool {
+	mediaA, _, errA := mime.ParseMediaType(a)
+	mediaB, _, errB := mime.ParseMediaType(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return mediaA == mediaB
+}
+
+// FixContentTypes sets the content type of each file under prefix to the one inferred
+// from its extension, when it differs. Files with unknown extensions are left alone.
+// With dryRun, files are only logged and counted, not updated.
+// It returns the number of files fixed, or that would be fixed for dryRun.
+func FixContentTypes(ctx context.Context, bucketName, prefix string, dryRun bool) (fixed int, err error) {
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		want := inferContentType(attrs.Name)
+		if want == "" || sameMediaType(attrs.ContentType, want) {
+			return nil
+		}
+		if dryRun {
+			log.Printf("Would change content type of %q from %q to %q", attrs.Name, attrs.ContentType, want)
+			fixed++
+			return nil
+		}
+		handle := createStorageObject(bucketName, attrs.Name).Generation(attrs.Generation)
+		// Only update the file as it was listed, in case it was changed since.
+		_, err := handle.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).
+			Update(ctx, storage.ObjectAttrsToUpdate{ContentType: want})
+		if err != nil {
+			return err
+		}
+		fixed++
+		return nil
+	})
+	return fixed, err
+}
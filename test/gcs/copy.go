@@ -0,0 +1,270 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// copy.go defines functions copying many files within gcs
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// CopyStats summarizes a bulk copy
+type CopyStats struct {
+	// Objects is the number of files copied
+	Objects int
+	// Bytes is the total size of the files copied
+	Bytes int64
+	// CrossRegion tells if source and destination buckets are in different locations,
+	// it's false if the locations couldn't be determined
+	CrossRegion bool
+	// EgressBytes estimates the bytes billed as network egress, it's Bytes for
+	// cross region copies and 0 otherwise
+	EgressBytes int64
+	// Skipped is the number of files not copied because of SkipIdentical
+	Skipped int
+}
+
+// CopyOption configures Copy, CopyPrefix and CopyVerified
+type CopyOption func(*copyOptions)
+
+// copyOptions holds the settings of a single copy
+type copyOptions struct {
+	skipIdentical    bool
+	deleteOnMismatch bool
+}
+
+// SkipIdentical skips copying files whose destination already exists with the same size and
+// CRC32C, making repeated copies cheap. It costs an Attrs call per file on the destination.
+func SkipIdentical() CopyOption {
+	return func(o *copyOptions) {
+		o.skipIdentical = true
+	}
+}
+
+// DeleteOnMismatch makes CopyVerified delete a destination whose checksum doesn't match the source
+func DeleteOnMismatch() CopyOption {
+	return func(o *copyOptions) {
+		o.deleteOnMismatch = true
+	}
+}
+
+// isIdenticalCopy checks if dst already exists with the content of src
+func isIdenticalCopy(ctx context.Context, src *storage.ObjectAttrs, dst *storage.ObjectHandle) (bool, error) {
+	dstAttrs, err := dst.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return sameContent(src, dstAttrs), nil
+}
+
+// CopyPrefix copies all files under srcPrefix to dstPrefix, the part of each
+// file name after srcPrefix is appended as is to dstPrefix.
+// The returned stats estimate the egress cost of the copy, based on the locations
+// from the buckets attrs, so they are best-effort. Files skipped with SkipIdentical
+// aren't counted as copied.
+func CopyPrefix(ctx context.Context, srcBucketName, srcPrefix, dstBucketName, dstPrefix string, opts ...CopyOption) (CopyStats, error) {
+	var o copyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	stats := CopyStats{CrossRegion: isCrossRegion(ctx, srcBucketName, dstBucketName)}
+	err := iterateObjects(ctx, srcBucketName, srcPrefix, "", func(attrs *storage.ObjectAttrs) error {
+		dstPath := dstPrefix + strings.TrimPrefix(attrs.Name, srcPrefix)
+		if o.skipIdentical {
+			identical, err := isIdenticalCopy(ctx, attrs, createStorageObject(dstBucketName, dstPath))
+			if err != nil {
+				return err
+			}
+			if identical {
+				stats.Skipped++
+				return nil
+			}
+		}
+		if err := Copy(ctx, srcBucketName, attrs.Name, dstBucketName, dstPath); err != nil {
+			return err
+		}
+		stats.add(attrs.Size)
+		return nil
+	})
+	return stats, err
+}
+
+// CopyRename copies each file under srcPrefix to the dstBucket name returned by rename for its
+// full name, running up to concurrency copies at once. Files for which rename returns an empty
+// name are skipped. It returns the number of files copied.
+func CopyRename(ctx context.Context, srcBucket, srcPrefix, dstBucket string, rename func(oldKey string) (newKey string), concurrency int) (int, error) {
+	var copied int64
+	err := forEachObjectParallel(ctx, srcBucket, srcPrefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		newKey := rename(attrs.Name)
+		if newKey == "" {
+			return nil
+		}
+		if err := Copy(ctx, srcBucket, attrs.Name, dstBucket, newKey); err != nil {
+			return err
+		}
+		atomic.AddInt64(&copied, 1)
+		return nil
+	})
+	return int(copied), err
+}
+
+// add accounts for one copied file of given size
+func (s *CopyStats) add(size int64) {
+	s.Objects++
+	s.Bytes += size
+	if s.CrossRegion {
+		s.EgressBytes += size
+	}
+}
+
+// isCrossRegion checks if the two buckets are in different locations,
+// returning false if either location can't be read.
+func isCrossRegion(ctx context.Context, bucketA, bucketB string) bool {
+	if bucketA == bucketB {
+		return false
+	}
+	attrsA, err := client.Bucket(bucketA).Attrs(ctx)
+	if err != nil {
+		return false
+	}
+	attrsB, err := client.Bucket(bucketB).Attrs(ctx)
+	if err != nil {
+		return false
+	}
+	return !strings.EqualFold(attrsA.Location, attrsB.Location)
+}
+
+// crc32cTable is the Castagnoli table gcs computes CRC32C checksums with
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CopyAndHash copies the file by streaming it through this process, computing its CRC32C on the way,
+// so callers can verify the copy against the source's stored checksum independently of gcs.
+// It's much slower than the server-side Copy, as all bytes are downloaded and uploaded again.
+// Files are copied as stored, without decompressing gzip encoded ones.
+func CopyAndHash(ctx context.Context, srcBucket, srcPath, dstBucket, dstPath string) (crc32c uint32, err error) {
+	dstHandle, err := createDestinationObject(dstBucket, dstPath)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, dstBucket)
+	defer cancel()
+	srcHandle := createStorageObject(srcBucket, srcPath)
+	attrs, err := srcHandle.Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	src, err := srcHandle.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst := newProfiledWriter(ctx, dstHandle)
+	keepEditableAttrs(&dst.ObjectAttrs, attrs)
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(dst, h), limitByBudget(ctx, src)); err != nil {
+		dst.CloseWithError(err)
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// keepEditableAttrs copies the editable attributes of src to dst, the attributes of a Copier.
+// A rewrite with any destination attributes set doesn't copy the other attributes
+// from the source, so they must all be passed explicitly to be kept.
+func keepEditableAttrs(dst, src *storage.ObjectAttrs) {
+	dst.ContentType = src.ContentType
+	dst.ContentEncoding = src.ContentEncoding
+	dst.ContentLanguage = src.ContentLanguage
+	dst.ContentDisposition = src.ContentDisposition
+	dst.CacheControl = src.CacheControl
+	dst.Metadata = src.Metadata
+}
+
+// Metadata keys holding the RFC 3339 creation and update times of the original of a copy
+const (
+	OrigCreatedMetadata = "orig-created"
+	OrigUpdatedMetadata = "orig-updated"
+)
+
+// CopyPreservingTimes is Copy, but also stamps the creation and update times of the source in the
+// destination metadata, as a copy gets new times. Sources that are themselves such copies pass on
+// their original times. Use OriginalTimes to read them back.
+func CopyPreservingTimes(ctx context.Context, srcBucketName, srcPath, dstBucketName, dstPath string) error {
+	dst, err := createDestinationObject(dstBucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, dstBucketName)
+	defer cancel()
+	src := createStorageObject(srcBucketName, srcPath)
+	attrs, err := src.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	copier := dst.CopierFrom(src.Generation(attrs.Generation))
+	keepEditableAttrs(&copier.ObjectAttrs, attrs)
+	copier.Metadata = make(map[string]string)
+	for k, v := range attrs.Metadata {
+		copier.Metadata[k] = v
+	}
+	if _, ok := copier.Metadata[OrigCreatedMetadata]; !ok {
+		copier.Metadata[OrigCreatedMetadata] = attrs.Created.UTC().Format(time.RFC3339Nano)
+	}
+	if _, ok := copier.Metadata[OrigUpdatedMetadata]; !ok {
+		copier.Metadata[OrigUpdatedMetadata] = attrs.Updated.UTC().Format(time.RFC3339Nano)
+	}
+	return withRetry(ctx, dstBucketName, func() error {
+		_, err := copier.Run(ctx)
+		return err
+	})
+}
+
+// OriginalTimes returns the creation and update times of the original of a file copied with
+// CopyPreservingTimes, or the file's own times if it isn't such a copy.
+func OriginalTimes(ctx context.Context, bucketName, filePath string) (created, updated time.Time, err error) {
+	attrs, err := createStorageObject(bucketName, filePath).Attrs(ctx)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	created, updated = attrs.Created, attrs.Updated
+	if v, ok := attrs.Metadata[OrigCreatedMetadata]; ok {
+		if created, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid original creation time %q of %q: %v", v, filePath, err)
+		}
+	}
+	if v, ok := attrs.Metadata[OrigUpdatedMetadata]; ok {
+		if updated, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid original update time %q of %q: %v", v, filePath, err)
+		}
+	}
+	return created, updated, nil
+}
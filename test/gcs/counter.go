@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// counter.go defines a counter backed by a single gcs file
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IncrementCounter adds delta to the decimal integer stored in filePath and returns the new value.
+// A missing file counts as 0, and a delta of 0 reads the counter without changing it.
+// Like the KV functions, increments are read-modify-write cycles guarded by the generation read
+// and retried on conflicts, so concurrent increments are never lost. GCS sustains about one write
+// per second to a single file though, so under heavy contention the retries run out and
+// IncrementCounter fails without having applied delta.
+func IncrementCounter(ctx context.Context, bucketName, filePath string, delta int64) (int64, error) {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return 0, err
+	}
+	if delta == 0 {
+		contents, _, err := readCurrent(ctx, handle)
+		if err != nil {
+			return 0, err
+		}
+		return parseCounter(filePath, contents)
+	}
+	var value int64
+	err = updateObject(ctx, handle, "text/plain", func(contents []byte) ([]byte, error) {
+		current, err := parseCounter(filePath, contents)
+		if err != nil {
+			return nil, err
+		}
+		value = current + delta
+		return []byte(strconv.FormatInt(value, 10)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// parseCounter parses the content of a counter file, nil content being 0
+func parseCounter(filePath string, contents []byte) (int64, error) {
+	if contents == nil {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid counter file %q: %v", filePath, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestIncrementCounterInterleaved(t *testing.T) {
+	tests := []struct {
+		name string
+		// other increments the counter once, when the tested call first sends a request to method and path
+		request string
+		delta   int64
+		want    int64
+	}{
+		{"replaced while read", http.MethodGet + " /bucket/counter", 1, 3},
+		{"replaced before write", http.MethodPost + " /storage/v1/b/bucket/o", 1, 3},
+		{"read replaced", http.MethodGet + " /bucket/counter", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			m.put("counter", []byte("1"))
+			interleaved := false
+			m.before = func(r *http.Request) {
+				if interleaved || r.Method+" "+r.URL.Path != test.request {
+					return
+				}
+				interleaved = true
+				if _, err := IncrementCounter(context.Background(), "bucket", "counter", 1); err != nil {
+					t.Errorf("Interleaved increment failed: %v", err)
+				}
+			}
+
+			got, err := IncrementCounter(context.Background(), "bucket", "counter", test.delta)
+			if err != nil {
+				t.Fatalf("IncrementCounter() = %v", err)
+			}
+			if !interleaved {
+				t.Fatalf("IncrementCounter() sent no %s request", test.request)
+			}
+			if got != test.want {
+				t.Errorf("IncrementCounter() = %d, want %d", got, test.want)
+			}
+			if data, _ := m.get("counter"); string(data) != strconv.FormatInt(test.want, 10) {
+				t.Errorf("Counter file = %q, want %d", data, test.want)
+			}
+		})
+	}
+}
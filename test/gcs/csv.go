@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// csv.go defines functions reading gcs CSV files record by record
+
+package gcs
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadCSVRecords streams the CSV file and calls fn with each row after the header line, as a map
+// from column name to value, stopping at the first error fn returns. Quoting is handled as by
+// encoding/csv, and gzip compressed files are decompressed transparently. Rows must have as
+// many fields as the header, and column names must be unique. An empty file has no rows.
+func ReadCSVRecords(ctx context.Context, bucketName, filePath string, fn func(row map[string]string) error) error {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src, err := maybeGunzip(limitByBudget(ctx, f))
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(src)
+	// Fields are copied into each row map, so the record slice can be reused.
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid CSV header of %q: %v", filePath, err)
+	}
+	columns := make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, name := range header {
+		if i == 0 {
+			// Spreadsheet exports often start with a UTF-8 byte order mark.
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if seen[name] {
+			return fmt.Errorf("invalid CSV header of %q: duplicate column %q", filePath, name)
+		}
+		seen[name] = true
+		columns[i] = name
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid CSV file %q: %v", filePath, err)
+		}
+		row := make(map[string]string, len(columns))
+		for i, name := range columns {
+			row[name] = record[i]
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
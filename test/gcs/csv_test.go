@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// gzipped compresses s
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadCSVRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    []map[string]string
+		wantErr bool
+	}{
+		{name: "empty", content: []byte("")},
+		{name: "header only", content: []byte("a,b\n")},
+		{
+			name:    "rows",
+			content: []byte("a,b\n1,2\n3,4\n"),
+			want:    []map[string]string{{"a": "1", "b": "2"}, {"a": "3", "b": "4"}},
+		},
+		{
+			name:    "quoted",
+			content: []byte("a,b\n\"x,y\",\"multi\nline\"\n"),
+			want:    []map[string]string{{"a": "x,y", "b": "multi\nline"}},
+		},
+		{
+			name:    "byte order mark",
+			content: []byte("\ufeffa,b\n1,2\n"),
+			want:    []map[string]string{{"a": "1", "b": "2"}},
+		},
+		{
+			name:    "gzipped",
+			content: gzipped(t, "a\n1\n"),
+			want:    []map[string]string{{"a": "1"}},
+		},
+		{name: "duplicate column", content: []byte("a,a\n1,2\n"), wantErr: true},
+		{name: "missing field", content: []byte("a,b\n1\n"), wantErr: true},
+		{name: "extra field", content: []byte("a,b\n1,2,3\n"), wantErr: true},
+		{name: "bad quote", content: []byte("a\n\"1\n"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			m.put("file.csv", test.content)
+
+			var got []map[string]string
+			err := ReadCSVRecords(context.Background(), "bucket", "file.csv", func(row map[string]string) error {
+				got = append(got, row)
+				return nil
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ReadCSVRecords() = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ReadCSVRecords() rows = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadCSVRecordsStops(t *testing.T) {
+	m := newMemGCS(t)
+	defer m.Close()
+	m.put("file.csv", []byte("a\n1\n2\n3\n"))
+	stop := errors.New("stop")
+	rows := 0
+	err := ReadCSVRecords(context.Background(), "bucket", "file.csv", func(map[string]string) error {
+		rows++
+		return stop
+	})
+	if err != stop || rows != 1 {
+		t.Errorf("ReadCSVRecords() = %v after %d rows, want %v after 1", err, rows, stop)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// decode.go defines functions reading structured or encoded files from gcs, and writing them
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghodss/yaml"
+)
+
+// SchemaVersionMetadata is the metadata key WriteVersioned stores schema versions under
+const SchemaVersionMetadata = "schema-version"
+
+// SchemaVersionError is returned by ReadVersioned for files of a too old schema version
+type SchemaVersionError struct {
+	// Path is the path of the file
+	Path string
+	// Version is the schema version of the file, 0 if it has none
+	Version int
+	// MinVersion is the minimum schema version required
+	MinVersion int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("schema version %d of %q is older than the minimum version %d", e.Version, e.Path, e.MinVersion)
+}
+
+// ReadDecoded reads the specified file and decodes it into v,
+// as JSON for ".json" files and as YAML for ".yaml" or ".yml" files.
+func ReadDecoded(ctx context.Context, bucketName, filePath string, v interface{}) error {
+	var unmarshal func([]byte, interface{}) error
+	switch ext := strings.ToLower(path.Ext(filePath)); ext {
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	default:
+		return fmt.Errorf("cannot decode %q: unsupported extension %q", filePath, ext)
+	}
+	contents, err := Read(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	if err := unmarshal(contents, v); err != nil {
+		return fmt.Errorf("cannot decode %q: %v", filePath, err)
+	}
+	return nil
+}
+
+// ReadBase64 reads the specified file and decodes its standard base64 content.
+// Surrounding whitespace, such as a trailing newline, is ignored.
+func ReadBase64(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	contents, err := Read(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	contents = bytes.TrimSpace(contents)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(contents)))
+	n, err := base64.StdEncoding.Decode(decoded, contents)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %q as base64: %v", filePath, err)
+	}
+	return decoded[:n], nil
+}
+
+// ReadHex reads the specified file and decodes its hexadecimal content.
+// Surrounding whitespace, such as a trailing newline, is ignored.
+func ReadHex(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	contents, err := Read(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	contents = bytes.TrimSpace(contents)
+	decoded := make([]byte, hex.DecodedLen(len(contents)))
+	n, err := hex.Decode(decoded, contents)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %q as hex: %v", filePath, err)
+	}
+	return decoded[:n], nil
+}
+
+// WriteVersioned writes v as JSON to filePath, stamping schemaVersion in its metadata for
+// ReadVersioned to check.
+func WriteVersioned(ctx context.Context, bucketName, filePath string, v interface{}, schemaVersion int) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cannot encode %q: %v", filePath, err)
+	}
+	attrs := &storage.ObjectAttrs{
+		ContentType: "application/json",
+		Metadata:    map[string]string{SchemaVersionMetadata: strconv.Itoa(schemaVersion)},
+	}
+	_, err = writeObject(ctx, handle, data, attrs)
+	return err
+}
+
+// ReadVersioned reads the JSON file written by WriteVersioned and decodes it into v, unless its
+// schema version is below minVersion, in which case a *SchemaVersionError is returned and v is
+// left untouched. Files without a schema version are of version 0.
+func ReadVersioned(ctx context.Context, bucketName, filePath string, v interface{}, minVersion int) error {
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if s, ok := attrs.Metadata[SchemaVersionMetadata]; ok {
+		if version, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf("invalid schema version %q of %q: %v", s, filePath, err)
+		}
+	}
+	if version < minVersion {
+		return &SchemaVersionError{Path: filePath, Version: version, MinVersion: minVersion}
+	}
+	// Reading the generation checked keeps a concurrent rewrite from slipping through.
+	contents, err := readGeneration(ctx, handle, attrs.Generation)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, v); err != nil {
+		return fmt.Errorf("cannot decode %q: %v", filePath, err)
+	}
+	return nil
+}
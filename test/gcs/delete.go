@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// delete.go defines functions deleting many files from gcs
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// deletePageSize is the number of files deleted between two checkpoints
+const deletePageSize = 1000
+
+// deleteCheckpoint is the progress of DeletePrefixCheckpointed saved in its state file
+type deleteCheckpoint struct {
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	PageToken string `json:"pageToken"`
+	Deleted   int    `json:"deleted"`
+}
+
+// DeletePrefix deletes all files under prefix, returning the number of files deleted
+func DeletePrefix(ctx context.Context, bucketName, prefix string) (int, error) {
+	deleted := 0
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if err := createStorageObject(bucketName, attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	return deleted, err
+}
+
+// DeletePrefixCheckpointed is DeletePrefix for prefixes too large to delete in a single run.
+// Progress is saved to the local stateFile after each page of deleted files, and a run
+// started with an existing stateFile resumes listing from the saved position instead
+// of from the top. The returned count covers all runs, stateFile is removed once done.
+// A run failing within a page saves the files deleted so far along with the position of the
+// page, which is listed again on resume, without them. Only a run killed within a page loses
+// count of up to deletePageSize files, deleted but not yet saved.
+func DeletePrefixCheckpointed(ctx context.Context, bucketName, prefix, stateFile string) (int, error) {
+	cp := deleteCheckpoint{Bucket: bucketName, Prefix: prefix}
+	if contents, err := ioutil.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(contents, &cp); err != nil {
+			return 0, fmt.Errorf("invalid state file %q: %v", stateFile, err)
+		}
+		if cp.Bucket != bucketName || cp.Prefix != prefix {
+			return 0, fmt.Errorf("state file %q is for gs://%s/%s", stateFile, cp.Bucket, cp.Prefix)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	bucketHandle := client.Bucket(bucketName)
+	it := bucketHandle.Objects(ctx, scopedQuery(&storage.Query{Prefix: prefix}))
+	pager := iterator.NewPager(it, deletePageSize, cp.PageToken)
+	for {
+		if err := waitForListPage(ctx, it.PageInfo(), false); err != nil {
+			return cp.Deleted, err
+		}
+		var page []*storage.ObjectAttrs
+		token, err := pager.NextPage(&page)
+		if err != nil {
+			return cp.Deleted, err
+		}
+		for _, attrs := range page {
+			// Names come straight from gcs, so they already have the key prefix and hash.
+			if err := bucketHandle.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				if saveErr := saveDeleteCheckpoint(stateFile, cp); saveErr != nil {
+					log.Printf("Failed saving delete checkpoint %q: %v", stateFile, saveErr)
+				}
+				return cp.Deleted, err
+			}
+			cp.Deleted++
+		}
+		if token == "" {
+			break
+		}
+		cp.PageToken = token
+		if err := saveDeleteCheckpoint(stateFile, cp); err != nil {
+			return cp.Deleted, err
+		}
+	}
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		return cp.Deleted, err
+	}
+	return cp.Deleted, nil
+}
+
+// saveDeleteCheckpoint atomically replaces stateFile with cp
+func saveDeleteCheckpoint(stateFile string, cp deleteCheckpoint) error {
+	contents, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmpFile := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, stateFile)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// delta.go defines functions comparing the content of two gcs paths and reconciling them
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// objectStream pulls the files under a prefix one at a time, in lexicographic order of their keys.
+// Without key hashing that's the order gcs lists them in, hashed names come in hash order though,
+// so with key hashing the whole listing is collected and sorted first.
+type objectStream struct {
+	ctx     context.Context
+	it      *storage.ObjectIterator
+	prefix  string
+	started bool
+	// sorted holds the files not returned yet once the listing is collected
+	sorted []*storage.ObjectAttrs
+}
+
+// newObjectStream creates an objectStream of all files under prefix
+func newObjectStream(ctx context.Context, bucketName, prefix string) *objectStream {
+	return &objectStream{
+		ctx:    ctx,
+		it:     client.Bucket(bucketName).Objects(ctx, scopedQuery(&storage.Query{Prefix: prefix})),
+		prefix: prefix,
+	}
+}
+
+// next returns the next file and its name relative to the prefix, or nil once all files were returned
+func (s *objectStream) next() (*storage.ObjectAttrs, string, error) {
+	if keyHashLength == 0 {
+		attrs, err := s.pull()
+		if attrs == nil || err != nil {
+			return nil, "", err
+		}
+		return attrs, strings.TrimPrefix(attrs.Name, s.prefix), nil
+	}
+	if !s.started {
+		for {
+			attrs, err := s.pull()
+			if err != nil {
+				return nil, "", err
+			}
+			if attrs == nil {
+				break
+			}
+			s.sorted = append(s.sorted, attrs)
+		}
+		sort.Slice(s.sorted, func(i, j int) bool { return s.sorted[i].Name < s.sorted[j].Name })
+	}
+	if len(s.sorted) == 0 {
+		return nil, "", nil
+	}
+	attrs := s.sorted[0]
+	s.sorted = s.sorted[1:]
+	return attrs, strings.TrimPrefix(attrs.Name, s.prefix), nil
+}
+
+// pull returns the next file gcs lists, or nil once all files were listed
+func (s *objectStream) pull() (*storage.ObjectAttrs, error) {
+	if err := waitForListPage(s.ctx, s.it.PageInfo(), s.started); err != nil {
+		return nil, err
+	}
+	s.started = true
+	attrs, err := s.it.Next()
+	if err == iterator.Done {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolveNames(attrs)
+	return attrs, nil
+}
+
+// sameContent compares two files by size and CRC32C
+func sameContent(a, b *storage.ObjectAttrs) bool {
+	return a.Size == b.Size && a.CRC32C == b.CRC32C
+}
+
+// Delta compares the files under srcPrefix with the ones under dstPrefix, by name relative
+// to the prefixes and by CRC32C. It returns the relative names of files only in source (added),
+// in both but with different content (changed), and only in destination (removed).
+// Both listings are streamed and merged in order, so memory only grows with the results, unless
+// key hashing is enabled: listings then come in hash order, so both are held in memory to be sorted.
+func Delta(ctx context.Context, srcBucket, srcPrefix, dstBucket, dstPrefix string) (added, changed, removed []string, err error) {
+	added, changed, removed, _, err = delta(ctx, srcBucket, srcPrefix, dstBucket, dstPrefix, false)
+	return added, changed, removed, err
+}
+
+// delta is Delta, also returning the relative names of files identical on both sides (unchanged)
+// if keepUnchanged is set
+func delta(ctx context.Context, srcBucket, srcPrefix, dstBucket, dstPrefix string, keepUnchanged bool) (added, changed, removed, unchanged []string, err error) {
+	src := newObjectStream(ctx, srcBucket, srcPrefix)
+	dst := newObjectStream(ctx, dstBucket, dstPrefix)
+	s, sKey, err := src.next()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	d, dKey, err := dst.next()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	for s != nil || d != nil {
+		advanceSrc, advanceDst := false, false
+		switch {
+		case d == nil || (s != nil && sKey < dKey):
+			added = append(added, sKey)
+			advanceSrc = true
+		case s == nil || dKey < sKey:
+			removed = append(removed, dKey)
+			advanceDst = true
+		default:
+			if !sameContent(s, d) {
+				changed = append(changed, sKey)
+			} else if keepUnchanged {
+				unchanged = append(unchanged, sKey)
+			}
+			advanceSrc, advanceDst = true, true
+		}
+		if advanceSrc {
+			if s, sKey, err = src.next(); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+		if advanceDst {
+			if d, dKey, err = dst.next(); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+	}
+	return added, changed, removed, unchanged, nil
+}
+
+// ManifestEqual checks if prefixA and prefixB of the bucket hold the same files, by name relative
+// to the prefixes and by CRC32C, e.g. the outputs of two runs of a reproducible build.
+// It also returns the sorted relative names of files differing or only on one side.
+func ManifestEqual(ctx context.Context, bucketName, prefixA, prefixB string) (bool, []string, error) {
+	added, changed, removed, err := Delta(ctx, bucketName, prefixA, bucketName, prefixB)
+	if err != nil {
+		return false, nil, err
+	}
+	differing := append(append(added, changed...), removed...)
+	sort.Strings(differing)
+	return len(differing) == 0, differing, nil
+}
+
+// Plan lists what makes a destination prefix match a source prefix, see ReconcilePlan.
+// File names are relative to the prefixes.
+type Plan struct {
+	SrcBucket string
+	SrcPrefix string
+	DstBucket string
+	DstPrefix string
+	// Copies are the files missing or different in the destination
+	Copies []string
+	// Deletes are the files only in the destination
+	Deletes []string
+	// NoOps are the files already identical on both sides
+	NoOps []string
+}
+
+// ReconcilePlan compares the files under srcPrefix with the ones under dstPrefix, as Delta does,
+// and returns the plan making the destination a mirror of the source, without changing anything.
+// Review it, then run it with ApplyPlan.
+func ReconcilePlan(ctx context.Context, srcBucket, srcPrefix, dstBucket, dstPrefix string) (Plan, error) {
+	added, changed, removed, unchanged, err := delta(ctx, srcBucket, srcPrefix, dstBucket, dstPrefix, true)
+	if err != nil {
+		return Plan{}, err
+	}
+	copies := append(added, changed...)
+	sort.Strings(copies)
+	return Plan{
+		SrcBucket: srcBucket,
+		SrcPrefix: srcPrefix,
+		DstBucket: dstBucket,
+		DstPrefix: dstPrefix,
+		Copies:    copies,
+		Deletes:   removed,
+		NoOps:     unchanged,
+	}, nil
+}
+
+// ApplyPlan runs the copies then the deletes of plan. Files changed since the plan was made are
+// copied or deleted as they are now, and files already deleted are ignored. A failed copy or
+// delete doesn't stop the others, the returned error lists every file that failed.
+func ApplyPlan(ctx context.Context, plan Plan) error {
+	var failures []string
+	for _, name := range plan.Copies {
+		if err := Copy(ctx, plan.SrcBucket, plan.SrcPrefix+name, plan.DstBucket, plan.DstPrefix+name); err != nil {
+			failures = append(failures, fmt.Sprintf("copy of %s: %v", name, err))
+		}
+	}
+	for _, name := range plan.Deletes {
+		err := createStorageObject(plan.DstBucket, plan.DstPrefix+name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			failures = append(failures, fmt.Sprintf("delete of %s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed applying %d of %d plan steps: %s", len(failures), len(plan.Copies)+len(plan.Deletes), strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestObjectStreamHashedOrder(t *testing.T) {
+	EnableKeyHashing(2)
+	defer EnableKeyHashing(0)
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	hashed := make([]string, len(keys))
+	for i, key := range keys {
+		hashed[i] = HashedKey(key)
+	}
+	if sort.StringsAreSorted(hashed) {
+		t.Fatalf("Hashed keys %v are listed in key order, pick other keys", hashed)
+	}
+
+	m := newMemGCS(t)
+	defer m.Close()
+	for _, name := range hashed {
+		m.put(name, []byte(name))
+	}
+	s := newObjectStream(context.Background(), "bucket", "")
+	var got []string
+	for {
+		attrs, name, err := s.next()
+		if err != nil {
+			t.Fatalf("next() = %v", err)
+		}
+		if attrs == nil {
+			break
+		}
+		got = append(got, name)
+	}
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("Streamed keys = %v, want %v", got, keys)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// diff.go defines functions comparing text files stored in gcs
+
+package gcs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around each change
+	diffContext = 3
+	// maxLineSize is the longest line accepted when reading files line by line
+	maxLineSize = 1024 * 1024
+)
+
+// diffOp is a single line of an edit script, kind is one of ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// Diff writes a unified diff of two text files to w, nothing is written if they are identical.
+// The common leading lines are streamed and discarded, only the part of the files
+// starting at the first difference is held in memory, so mostly identical large files are cheap.
+func Diff(ctx context.Context, bucketA, pathA, bucketB, pathB string, w io.Writer) error {
+	ra, err := NewReader(ctx, bucketA, pathA)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	rb, err := NewReader(ctx, bucketB, pathB)
+	if err != nil {
+		return err
+	}
+	defer rb.Close()
+
+	sa := newLineScanner(limitByBudget(ctx, ra))
+	sb := newLineScanner(limitByBudget(ctx, rb))
+	// Skip the common prefix, only remembering the last few lines as context.
+	var common []string
+	offset := 0
+	var a, b []string
+	for {
+		okA, okB := sa.Scan(), sb.Scan()
+		if okA && okB && sa.Text() == sb.Text() {
+			common = append(common, sa.Text())
+			if len(common) > diffContext {
+				common = common[1:]
+				offset++
+			}
+			continue
+		}
+		if okA {
+			a = append(a, sa.Text())
+		}
+		if okB {
+			b = append(b, sb.Text())
+		}
+		break
+	}
+	for sa.Scan() {
+		a = append(a, sa.Text())
+	}
+	for sb.Scan() {
+		b = append(b, sb.Text())
+	}
+	if err := sa.Err(); err != nil {
+		return err
+	}
+	if err := sb.Err(); err != nil {
+		return err
+	}
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+
+	a = append(append([]string{}, common...), a...)
+	b = append(append([]string{}, common...), b...)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s%s/%s\n+++ %s%s/%s\n", gcsScheme, bucketA, pathA, gcsScheme, bucketB, pathB)
+	writeHunks(bw, diffLines(a, b), offset)
+	return bw.Flush()
+}
+
+// newLineScanner creates a Scanner splitting r into lines of up to maxLineSize
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineSize)
+	return s
+}
+
+// diffLines computes the shortest edit script turning a into b, using Myers' algorithm.
+// See "An O(ND) Difference Algorithm and Its Variations", Eugene W. Myers.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+2)
+	// trace[d] keeps v[-d..d] as it was before round d, for backtracking.
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int{}, v[max-d:max+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		vd := trace[d]
+		get := func(k int) int { return vd[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// writeHunks writes ops as unified diff hunks, offset is the number of lines
+// both files had before the first op.
+func writeHunks(w io.Writer, ops []diffOp, offset int) {
+	// aBefore[i] and bBefore[i] are the number of lines of each file before ops[i].
+	aBefore := make([]int, len(ops)+1)
+	bBefore := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aBefore[i+1], bBefore[i+1] = aBefore[i], bBefore[i]
+		if op.kind != '+' {
+			aBefore[i+1]++
+		}
+		if op.kind != '-' {
+			bBefore[i+1]++
+		}
+	}
+
+	i := 0
+	for i < len(ops) {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// Merge changes separated by less than two contexts of unchanged lines.
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(offset+aBefore[start], aBefore[stop]-aBefore[start]),
+			hunkRange(offset+bBefore[start], bBefore[stop]-bBefore[start]))
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+		i = stop
+	}
+}
+
+// hunkRange formats the "start,count" part of a hunk header,
+// before is the number of lines preceding the hunk.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lines splits s into lines, "" being no line
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		// edits is the length of the shortest edit script
+		edits int
+	}{
+		{"both empty", "", "", 0},
+		{"identical", "a\nb\nc", "a\nb\nc", 0},
+		{"all added", "", "a\nb", 2},
+		{"all removed", "a\nb", "", 2},
+		{"replaced", "a", "b", 2},
+		{"inserted in the middle", "a\nc", "a\nb\nc", 1},
+		{"removed at the end", "a\nb\nc", "a\nb", 1},
+		{"moved", "a\nb\nc", "b\nc\na", 2},
+		{"Myers' example", "a\nb\nc\na\nb\nb\na", "c\nb\na\nb\na\nc", 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := lines(test.a), lines(test.b)
+			ops := diffLines(a, b)
+			// Kept and removed lines give back a, kept and added lines give b.
+			var gotA, gotB []string
+			edits := 0
+			for _, op := range ops {
+				switch op.kind {
+				case ' ':
+					gotA, gotB = append(gotA, op.line), append(gotB, op.line)
+				case '-':
+					gotA = append(gotA, op.line)
+					edits++
+				case '+':
+					gotB = append(gotB, op.line)
+					edits++
+				default:
+					t.Fatalf("diffLines() returned an op of kind %q", op.kind)
+				}
+			}
+			if !reflect.DeepEqual(gotA, a) || !reflect.DeepEqual(gotB, b) {
+				t.Errorf("diffLines() = %v, doesn't turn %q into %q", ops, a, b)
+			}
+			if edits != test.edits {
+				t.Errorf("diffLines() made %d edits, want %d", edits, test.edits)
+			}
+		})
+	}
+}
+
+func TestWriteHunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		offset int
+		want   string
+	}{
+		{"identical", "a\nb", "a\nb", 0, ""},
+		{"changed line", "a\nb\nc", "a\nx\nc", 0, "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"offset", "a\nb", "a\nx", 10, "@@ -11,2 +11,2 @@\n a\n-b\n+x\n"},
+		{"added to empty", "", "a\nb", 0, "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed all", "a", "", 0, "@@ -1,1 +0,0 @@\n-a\n"},
+		{
+			name: "context trimmed",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8",
+			b:    "1\n2\n3\n4\nx\n6\n7\n8",
+			want: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			name: "close changes merged",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8",
+			b:    "x\n2\n3\n4\n5\n6\n7\ny",
+			want: "@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+		},
+		{
+			name: "distant changes split",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			b:    "x\n2\n3\n4\n5\n6\n7\n8\ny",
+			want: "@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -6,4 +6,4 @@\n 6\n 7\n 8\n-9\n+y\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got bytes.Buffer
+			writeHunks(&got, diffLines(lines(test.a), lines(test.b)), test.offset)
+			if got.String() != test.want {
+				t.Errorf("writeHunks() =\n%s\nwant\n%s", got.String(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// digest.go defines functions computing digests of gcs files and of uploads
+
+package gcs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// SHA256Metadata is the metadata key UploadWithHashes stores the hex SHA256 of the content under
+const SHA256Metadata = "sha256"
+
+// Hash streams the specified file through h and returns the resulting sum, without keeping
+// the content in memory or on disk. h is reset first, so it can be reused across calls.
+func Hash(ctx context.Context, bucketName, filePath string, h hash.Hash) ([]byte, error) {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h.Reset()
+	if _, err := io.Copy(h, limitByBudget(ctx, f)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// UploadWithHashes uploads the content of r to gcs dstPath and returns its CRC32C, MD5 and SHA256,
+// all computed in the same pass as the upload. The CRC32C is checked against the one computed by
+// gcs. GCS doesn't compute SHA256, so it's stored hex encoded in the SHA256Metadata metadata,
+// set once the content is uploaded, as it's only known then.
+func UploadWithHashes(ctx context.Context, bucketName, dstPath string, r io.Reader) (crc32c uint32, md5Sum, sha256Sum []byte, err error) {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	w := newProfiledWriter(ctx, handle)
+	w.ContentType = inferContentType(dstPath)
+	crcHash, md5Hash, shaHash := crc32.New(crc32cTable), md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, crcHash, md5Hash, shaHash), capUpload(r)); err != nil {
+		w.CloseWithError(err)
+		return 0, nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, nil, err
+	}
+	attrs := w.Attrs()
+	if attrs.CRC32C != crcHash.Sum32() {
+		return 0, nil, nil, fmt.Errorf("upload of %q got corrupted: CRC32C is %08x, uploaded %08x", dstPath, attrs.CRC32C, crcHash.Sum32())
+	}
+	sha256Sum = shaHash.Sum(nil)
+	update := storage.ObjectAttrsToUpdate{Metadata: map[string]string{SHA256Metadata: hex.EncodeToString(sha256Sum)}}
+	if _, err := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).Update(ctx, update); err != nil {
+		return 0, nil, nil, fmt.Errorf("failed storing SHA256 of %q: %v", dstPath, err)
+	}
+	return crcHash.Sum32(), md5Hash.Sum(nil), sha256Sum, nil
+}
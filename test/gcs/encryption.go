@@ -0,0 +1,234 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// encryption.go defines functions managing the encryption of gcs files, server or client side
+
+package gcs
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+)
+
+// RewriteWithKey rewrites all files under prefix in place, encrypted with the Cloud KMS key
+// newKey ("projects/P/locations/L/keyRings/R/cryptoKeys/K"), running up to concurrency
+// rewrites at once, and returns the number of files rewritten.
+// Files are encrypted with the primary version of the key at rewrite time, so after rotating
+// a key, rewriting with that same key re-encrypts files still under an older version.
+// Files replaced since they were listed are skipped rather than reverted to their listed
+// content, run it again to rewrite them.
+func RewriteWithKey(ctx context.Context, bucketName, prefix string, newKey string, concurrency int) (int, error) {
+	var rewritten int64
+	err := forEachObjectParallel(ctx, bucketName, prefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		handle, err := createDestinationObject(bucketName, attrs.Name)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := withBucketTimeout(ctx, bucketName)
+		defer cancel()
+		copier := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).CopierFrom(handle.Generation(attrs.Generation))
+		keepEditableAttrs(&copier.ObjectAttrs, attrs)
+		copier.DestinationKMSKeyName = newKey
+		err = withRetry(ctx, bucketName, func() error {
+			_, err := copier.Run(ctx)
+			return err
+		})
+		if isPreconditionFailed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&rewritten, 1)
+		return nil
+	})
+	return int(rewritten), err
+}
+
+// NonceMetadata is the metadata key holding the base64 nonce of files uploaded by UploadEncrypted
+const NonceMetadata = "encryption-nonce"
+
+// encryptedSegmentSize is the size of the plaintext segments sealed separately by UploadEncrypted
+const encryptedSegmentSize = 64 * 1024
+
+// errDecryption is returned when content can't be authenticated, hiding the cause
+var errDecryption = errors.New("gcs: decryption failed, wrong key or corrupted content")
+
+// UploadEncrypted encrypts local src with AES-GCM under key, 16, 24 or 32 bytes long, streaming
+// it to gcs dst, independently from gcs encryption: the file is readable with DownloadDecrypted
+// and key only. The content is split into 64KiB segments sealed separately, each with a nonce
+// derived from a random nonce stored in the NonceMetadata metadata, and the last one marked as
+// such so truncation is detected.
+func UploadEncrypted(ctx context.Context, bucketName, dst, src string, key []byte) error {
+	handle, err := createDestinationObject(bucketName, dst)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := newProfiledWriter(ctx, handle)
+	w.ContentType = "application/octet-stream"
+	w.Metadata = map[string]string{NonceMetadata: base64.StdEncoding.EncodeToString(nonce)}
+	if err := encryptSegments(aead, nonce, f, w); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	return w.Close()
+}
+
+// encryptSegments seals the content of r into segments written to w
+func encryptSegments(aead cipher.AEAD, nonce []byte, r io.Reader, w io.Writer) error {
+	br := bufio.NewReaderSize(r, encryptedSegmentSize)
+	plain := make([]byte, encryptedSegmentSize)
+	sealed := make([]byte, 0, encryptedSegmentSize+aead.Overhead())
+	for i := uint64(0); ; i++ {
+		n, last, err := readSegment(br, plain)
+		if err != nil {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(nonce, i), plain[:n], segmentAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DownloadDecrypted downloads gcs src, uploaded by UploadEncrypted, and decrypts it with key into
+// local dst as it streams. Content failing authentication, because of a wrong key, corruption or
+// truncation, fails the download, dst is removed then as part of it may have been written.
+func DownloadDecrypted(ctx context.Context, bucketName, src, dst string, key []byte) error {
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return err
+	}
+	handle := createStorageObject(bucketName, src)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(attrs.Metadata[NonceMetadata])
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return fmt.Errorf("%q has no valid %s metadata, it wasn't uploaded encrypted", src, NonceMetadata)
+	}
+	r, err := handle.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := decryptSegments(aead, nonce, limitByBudget(ctx, r), f); err != nil {
+		f.Close()
+		os.Remove(dst)
+		return err
+	}
+	return f.Close()
+}
+
+// decryptSegments opens the segments read from r and writes their plaintext to w
+func decryptSegments(aead cipher.AEAD, nonce []byte, r io.Reader, w io.Writer) error {
+	br := bufio.NewReaderSize(r, encryptedSegmentSize+aead.Overhead())
+	sealed := make([]byte, encryptedSegmentSize+aead.Overhead())
+	plain := make([]byte, 0, encryptedSegmentSize)
+	for i := uint64(0); ; i++ {
+		n, last, err := readSegment(br, sealed)
+		if err != nil {
+			return err
+		}
+		if plain, err = aead.Open(plain[:0], segmentNonce(nonce, i), sealed[:n], segmentAD(last)); err != nil {
+			return errDecryption
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// newSegmentAEAD creates the AES-GCM cipher of key
+func newSegmentAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readSegment fills buf from br, returning the number of bytes read and whether br is exhausted
+func readSegment(br *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(br, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if _, err := br.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// segmentNonce derives the nonce of segment i, xoring i into the last 8 bytes of the base nonce
+func segmentNonce(base []byte, i uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+	return nonce
+}
+
+// segmentAD is the additional data of a segment, marking the last one
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
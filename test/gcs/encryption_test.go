@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestRewriteWithKey(t *testing.T) {
+	const key = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"rewritten", http.StatusOK, 2},
+		// Files replaced since the listing are skipped instead of reverted.
+		{"replaced", http.StatusPreconditionFailed, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, rewriteServer(t, test.status, "dir/a", "dir/b"))
+			defer f.Close()
+
+			got, err := RewriteWithKey(context.Background(), "bucket", "dir/", key, 2)
+			if err != nil {
+				t.Fatalf("RewriteWithKey() = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("RewriteWithKey() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSegmentFraming(t *testing.T) {
+	aead, err := newSegmentAEAD(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("newSegmentAEAD() = %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealedSize := encryptedSegmentSize + aead.Overhead()
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		// Empty content still has a last segment, so truncating everything is detected.
+		{"empty", 0, 1},
+		{"short", 10, 1},
+		{"one segment", encryptedSegmentSize, 1},
+		{"one byte over", encryptedSegmentSize + 1, 2},
+		{"two segments", 2 * encryptedSegmentSize, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plain := bytes.Repeat([]byte{'x'}, test.size)
+			var sealed bytes.Buffer
+			if err := encryptSegments(aead, nonce, bytes.NewReader(plain), &sealed); err != nil {
+				t.Fatalf("encryptSegments() = %v", err)
+			}
+			if want := test.size + test.segments*aead.Overhead(); sealed.Len() != want {
+				t.Errorf("Encrypted %d bytes into %d, want %d", test.size, sealed.Len(), want)
+			}
+			var got bytes.Buffer
+			if err := decryptSegments(aead, nonce, bytes.NewReader(sealed.Bytes()), &got); err != nil {
+				t.Fatalf("decryptSegments() = %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), plain) {
+				t.Errorf("Decrypted content differs from the original")
+			}
+
+			// Dropping the last segment must fail rather than return a prefix.
+			if test.segments > 1 {
+				truncated := sealed.Bytes()[:sealedSize]
+				if err := decryptSegments(aead, nonce, bytes.NewReader(truncated), ioutil.Discard); err != errDecryption {
+					t.Errorf("decryptSegments() of a truncated file = %v, want %v", err, errDecryption)
+				}
+			}
+			tampered := append([]byte{}, sealed.Bytes()...)
+			tampered[len(tampered)-1] ^= 1
+			if err := decryptSegments(aead, nonce, bytes.NewReader(tampered), ioutil.Discard); err != errDecryption {
+				t.Errorf("decryptSegments() of a tampered file = %v, want %v", err, errDecryption)
+			}
+		})
+	}
+}
+
+func TestSegmentFramingReordered(t *testing.T) {
+	aead, err := newSegmentAEAD(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("newSegmentAEAD() = %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	var sealed bytes.Buffer
+	plain := bytes.Repeat([]byte{'x'}, 3*encryptedSegmentSize)
+	if err := encryptSegments(aead, nonce, bytes.NewReader(plain), &sealed); err != nil {
+		t.Fatalf("encryptSegments() = %v", err)
+	}
+	// Swapping two segments of identical plaintext must still fail, as nonces depend on position.
+	size := encryptedSegmentSize + aead.Overhead()
+	s := sealed.Bytes()
+	swapped := append(append(append([]byte{}, s[size:2*size]...), s[:size]...), s[2*size:]...)
+	if err := decryptSegments(aead, nonce, bytes.NewReader(swapped), ioutil.Discard); err != errDecryption {
+		t.Errorf("decryptSegments() of reordered segments = %v, want %v", err, errDecryption)
+	}
+}
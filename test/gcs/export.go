@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// export.go defines functions exporting gcs listings to local files
+
+package gcs
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Index formats supported by ExportIndex
+const (
+	IndexFormatCSV = "csv"
+	IndexFormatTSV = "tsv"
+)
+
+// indexHeader is the header row of exported indexes
+var indexHeader = []string{"name", "size", "crc32c", "updated", "content_type"}
+
+// ExportIndex writes one row per file under prefix, with its name, size, crc32c (as hex),
+// update time and content type, to local outPath. format is IndexFormatCSV or IndexFormatTSV.
+// The listing is streamed to outPath, so memory stays flat for large prefixes.
+// SQLite output isn't supported, as it would need a database driver this package doesn't depend on,
+// the CSV can be imported with sqlite3's ".import" command instead.
+func ExportIndex(ctx context.Context, bucketName, prefix, outPath string, format string) error {
+	var comma rune
+	switch format {
+	case IndexFormatCSV:
+		comma = ','
+	case IndexFormatTSV:
+		comma = '\t'
+	default:
+		return fmt.Errorf("unsupported index format %q", format)
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Comma = comma
+	if err := w.Write(indexHeader); err != nil {
+		return err
+	}
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		return w.Write([]string{
+			attrs.Name,
+			strconv.FormatInt(attrs.Size, 10),
+			fmt.Sprintf("%08x", attrs.CRC32C),
+			attrs.Updated.UTC().Format(time.RFC3339),
+			attrs.ContentType,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// gcs.go defines functions to use GCS. The package started as a copy of
+// github.com/knative/test-infra/shared/gcs, which stays vendored as is for prow.
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+var client *storage.Client
+
+// ErrNotFound is returned when the requested gcs file doesn't exist
+var ErrNotFound = storage.ErrObjectNotExist
+
+// Authenticate explicitly sets up authentication for the rest of run
+func Authenticate(ctx context.Context, serviceAccount string) error {
+	var err error
+	client, err = storage.NewClient(ctx, option.WithCredentialsFile(serviceAccount))
+	return err
+}
+
+// AuthenticateWithOptions is Authenticate with arbitrary client options, e.g. for credentials
+// other than a service account file, or for a private endpoint:
+//
+//	option.WithEndpoint("https://storage-ENDPOINT.p.googleapis.com/storage/v1/")
+//
+// Endpoints are for the JSON API, so they must end with "/storage/v1/". The vendored storage
+// client always downloads file contents from storage.googleapis.com though, whatever the endpoint.
+// Behind VPC Service Controls, resolve storage.googleapis.com to restricted.googleapis.com
+// (199.36.153.4/30) in DNS instead, which covers all requests without any endpoint option.
+func AuthenticateWithOptions(ctx context.Context, opts ...option.ClientOption) error {
+	var err error
+	client, err = storage.NewClient(ctx, opts...)
+	return err
+}
+
+// Exist checks if path exist under gcs bucket
+func Exist(ctx context.Context, bucketName, filePath string) bool {
+	handle := createStorageObject(bucketName, filePath)
+	_, err := handle.Attrs(ctx)
+	return nil == err
+}
+
+// ListDirectChildren lists direct children paths (including files and directories).
+func ListDirectChildren(ctx context.Context, bucketName, storagePath string) ([]string, error) {
+	// If there are 2 directories named "foo" and "foobar",
+	// then given storagePath "foo" will get files both under "foo" and "foobar".
+	// Add trailling slash to storagePath, so that only gets children under given directory.
+	return list(ctx, bucketName, strings.TrimRight(storagePath, " /")+"/", "/", 0)
+}
+
+// Copy file from within gcs, transient failures are retried according to the retry policy
+func Copy(ctx context.Context, srcBucketName, srcPath, dstBucketName, dstPath string, opts ...CopyOption) error {
+	dst, err := createDestinationObject(dstBucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	var o copyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	src := createStorageObject(srcBucketName, srcPath)
+	if o.skipIdentical {
+		srcAttrs, err := src.Attrs(ctx)
+		if err != nil {
+			return err
+		}
+		if identical, err := isIdenticalCopy(ctx, srcAttrs, dst); err != nil || identical {
+			return err
+		}
+	}
+
+	// Retrying with the same copier resumes the rewrite from its last token,
+	// so large copies don't start over after a transient failure.
+	ctx, cancel := withBucketTimeout(ctx, dstBucketName)
+	defer cancel()
+	copier := dst.CopierFrom(src)
+	var size int64
+	err = withRetry(ctx, dstBucketName, func() error {
+		attrs, err := copier.Run(ctx)
+		if err == nil {
+			size = attrs.Size
+		}
+		return err
+	})
+	auditOp("copy", dstBucketName, dstPath, size, err)
+	return err
+}
+
+// Download file from gcs
+func Download(ctx context.Context, bucketName, srcPath, dstPath string) error {
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	handle := createStorageObject(bucketName, srcPath)
+	if _, err := handle.Attrs(ctx); nil != err {
+		return err
+	}
+
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	ctx, stalls, stop := watchStalls(ctx)
+	defer stop()
+	src, err := handle.NewReader(ctx)
+	if err != nil {
+		err = stalls.err(err)
+		auditOp("download", bucketName, srcPath, 0, err)
+		return err
+	}
+	defer src.Close()
+	n, err := io.Copy(dst, stalls.wrap(limitByBudget(ctx, src)))
+	auditOp("download", bucketName, srcPath, n, err)
+	return err
+}
+
+// DownloadTemp downloads the file to a new local temporary file and returns its path,
+// for tools needing a path rather than a reader. cleanup removes the temporary file,
+// it must be called once the file isn't needed anymore.
+func DownloadTemp(ctx context.Context, bucketName, filePath string) (localPath string, cleanup func(), err error) {
+	f, err := ioutil.TempFile("", "gcs-*-"+path.Base(filePath))
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	ctx, stalls, stop := watchStalls(ctx)
+	defer stop()
+	src, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, stalls.err(err)
+	}
+	defer src.Close()
+	if _, err := io.Copy(f, stalls.wrap(limitByBudget(ctx, src))); err != nil {
+		f.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// Upload file to gcs
+func Upload(ctx context.Context, bucketName, dstPath, srcPath string) error {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if nil != err {
+		return err
+	}
+	defer src.Close()
+	if info, err := src.Stat(); err == nil && maxUploadBytes > 0 && info.Size() > maxUploadBytes {
+		return ErrTooLarge
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	dst := newProfiledWriter(ctx, handle)
+	stampProvenance(&dst.ObjectAttrs)
+	// Aborting the writer on failure leaves no partial file behind.
+	n, err := io.Copy(dst, capUpload(src))
+	if nil != err {
+		dst.CloseWithError(err)
+	} else {
+		err = dst.Close()
+	}
+	auditOp("upload", bucketName, dstPath, n, err)
+	return err
+}
+
+// Read reads the specified file
+func Read(ctx context.Context, bucketName, filePath string) ([]byte, error) {
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	ctx, stalls, stop := watchStalls(ctx)
+	defer stop()
+	var contents []byte
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		err = stalls.err(err)
+		auditOp("read", bucketName, filePath, 0, err)
+		return contents, err
+	}
+	defer f.Close()
+	contents, err = ioutil.ReadAll(stalls.wrap(limitByBudget(ctx, f)))
+	auditOp("read", bucketName, filePath, int64(len(contents)), err)
+	if err != nil {
+		return contents, err
+	}
+	return contents, nil
+}
+
+// ReadWithAttrs reads the specified file and returns its attrs along, in a single request.
+// The attrs come from the read response, so only Bucket, Name, Size, ContentType, ContentEncoding,
+// CacheControl, Updated, Generation and Metageneration are set.
+// ErrNotFound is returned if the file doesn't exist.
+func ReadWithAttrs(ctx context.Context, bucketName, filePath string) ([]byte, *storage.ObjectAttrs, error) {
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	ctx, stalls, stop := watchStalls(ctx)
+	defer stop()
+	f, err := createStorageObject(bucketName, filePath).NewReader(ctx)
+	if err != nil {
+		err = stalls.err(err)
+		auditOp("read", bucketName, filePath, 0, err)
+		return nil, nil, err
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(stalls.wrap(limitByBudget(ctx, f)))
+	auditOp("read", bucketName, filePath, int64(len(contents)), err)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := &storage.ObjectAttrs{
+		Bucket:          bucketName,
+		Name:            filePath,
+		Size:            f.Attrs.Size,
+		ContentType:     f.Attrs.ContentType,
+		ContentEncoding: f.Attrs.ContentEncoding,
+		CacheControl:    f.Attrs.CacheControl,
+		Updated:         f.Attrs.LastModified,
+		Generation:      f.Attrs.Generation,
+		Metageneration:  f.Attrs.Metageneration,
+	}
+	return contents, attrs, nil
+}
+
+// NewReader creates a new Reader of a gcs file.
+// Important: caller must call Close on the returned Reader when done reading
+func NewReader(ctx context.Context, bucketName, filePath string) (*storage.Reader, error) {
+	o := createStorageObject(bucketName, filePath)
+	if _, err := o.Attrs(ctx); err != nil {
+		return nil, err
+	}
+	return o.NewReader(ctx)
+}
+
+// NewChainedReader creates a new Reader of the file in the first of buckets having it, e.g.
+// a cache bucket then the bucket it caches. Errors other than the file missing aren't
+// skipped over, they're returned right away. ErrNotFound is returned if all buckets miss.
+// Important: caller must call Close on the returned Reader when done reading
+func NewChainedReader(ctx context.Context, buckets []string, filePath string) (*storage.Reader, error) {
+	for _, bucketName := range buckets {
+		r, err := NewReader(ctx, bucketName, filePath)
+		if err != ErrNotFound {
+			return r, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// NewWriter creates a new Writer of a gcs file, its content type is inferred from the file extension.
+// The file is only created, or replaced, once Close returns successfully.
+// Important: caller must call Close on the returned Writer and check its error when done writing
+func NewWriter(ctx context.Context, bucketName, filePath string) (io.WriteCloser, error) {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	w := newProfiledWriter(ctx, handle)
+	w.ContentType = inferContentType(filePath)
+	return w, nil
+}
+
+// create storage object handle, this step doesn't access internet
+func createStorageObject(bucketName, filePath string) *storage.ObjectHandle {
+	return client.Bucket(bucketName).Object(objectName(filePath))
+}
+
+// ListObjects lists files under prefix, stopping the listing once limit files were collected,
+// so previews of huge prefixes stay fast. A limit of 0 or less means unlimited.
+func ListObjects(ctx context.Context, bucketName, prefix string, limit int) ([]*storage.ObjectAttrs, error) {
+	return collectObjectsAttrs(ctx, bucketName, prefix, "", limit)
+}
+
+// errListLimit stops iterateObjects once enough items were collected
+var errListLimit = errors.New("list limit reached")
+
+// collectObjectsAttrs returns up to limit items under given gcs storagePath, use delim to
+// eliminate some files. Stops after limit items, 0 or less means unlimited.
+// see https://godoc.org/cloud.google.com/go/storage#Query
+func collectObjectsAttrs(ctx context.Context, bucketName, storagePath, delim string, limit int) ([]*storage.ObjectAttrs, error) {
+	var allAttrs []*storage.ObjectAttrs
+	err := iterateObjects(ctx, bucketName, storagePath, delim, func(attrs *storage.ObjectAttrs) error {
+		allAttrs = append(allAttrs, attrs)
+		if limit > 0 && len(allAttrs) >= limit {
+			return errListLimit
+		}
+		return nil
+	})
+	if err == errListLimit {
+		err = nil
+	}
+	return allAttrs, err
+}
+
+// iterateObjects streams items under given gcs storagePath to fn, use delim to eliminate some files.
+// Object names are resolved back to paths, without key prefix and hash, so they can be passed
+// back to other functions.
+// Page fetches are subject to the rate limit set by SetListRateLimit.
+// Iteration stops at the first error, either from gcs or returned by fn.
+// see https://godoc.org/cloud.google.com/go/storage#Query
+func iterateObjects(ctx context.Context, bucketName, storagePath, delim string, fn func(*storage.ObjectAttrs) error) error {
+	return iterateQuery(ctx, bucketName, &storage.Query{
+		Prefix:    storagePath,
+		Delimiter: delim,
+	}, fn)
+}
+
+// iterateQuery is iterateObjects for arbitrary queries, e.g. listing all generations
+func iterateQuery(ctx context.Context, bucketName string, q *storage.Query, fn func(*storage.ObjectAttrs) error) error {
+	it := client.Bucket(bucketName).Objects(ctx, scopedQuery(q))
+	for started := false; ; started = true {
+		if err := waitForListPage(ctx, it.PageInfo(), started); err != nil {
+			return err
+		}
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resolveNames(attrs)
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+}
+
+// list child under storagePath, use exclusionFilter for skipping some files.
+// This function gets all child files recursively under given storagePath,
+// then filter out filenames containing giving exclusionFilter.
+// If exclusionFilter is empty string, returns all files but not directories,
+// if exclusionFilter is "/", returns all direct children, including both files and directories.
+// At most limit paths are returned, 0 or less means unlimited.
+// see https://godoc.org/cloud.google.com/go/storage#Query
+func list(ctx context.Context, bucketName, storagePath, exclusionFilter string, limit int) ([]string, error) {
+	var filePaths []string
+	objsAttrs, err := collectObjectsAttrs(ctx, bucketName, storagePath, exclusionFilter, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, attrs := range objsAttrs {
+		filePaths = append(filePaths, path.Join(attrs.Prefix, attrs.Name))
+	}
+	return filePaths, nil
+}
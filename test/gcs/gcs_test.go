@@ -0,0 +1,78 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// fakeGCS is a JSON API server answering every request with handler, and recording their
+// methods and paths
+type fakeGCS struct {
+	*httptest.Server
+	mu    sync.Mutex
+	paths []string
+}
+
+// newFakeGCS starts a fakeGCS and points the gcs package at it
+func newFakeGCS(t *testing.T, handler http.HandlerFunc) *fakeGCS {
+	f := &fakeGCS{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+	err := AuthenticateWithOptions(context.Background(),
+		option.WithEndpoint(f.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		f.Close()
+		t.Fatalf("Failed to authenticate with the fake server: %v", err)
+	}
+	return f
+}
+
+// requests returns the methods and paths of the requests received so far, e.g. "GET /storage/v1/b"
+func (f *fakeGCS) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.paths...)
+}
+
+func TestAuthenticateWithOptions(t *testing.T) {
+	f := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"bucket": "bucket", "name": "dir/file"}`)
+	})
+	defer f.Close()
+
+	if !Exist(context.Background(), "bucket", "dir/file") {
+		t.Error("Exist() = false, want true")
+	}
+	want := []string{"GET /storage/v1/b/bucket/o/dir/file"}
+	if got := f.requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got requests %v, want %v", got, want)
+	}
+}
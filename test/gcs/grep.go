@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// grep.go defines functions searching the content of gcs files
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// GrepObject streams the file, gzipped or not, and writes each line matching re to w.
+// It returns the number of matching lines.
+func GrepObject(ctx context.Context, bucketName, filePath string, re *regexp.Regexp, w io.Writer) (matches int, err error) {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return grepLines(limitByBudget(ctx, f), re, func(line []byte) error {
+		_, err := fmt.Fprintf(w, "%s\n", line)
+		return err
+	})
+}
+
+// GrepPrefix is GrepObject over all files under prefix, running up to concurrency files at once.
+// Each matching line is written to w prefixed with the file path, as "<path>:<line>". Lines are
+// written whole, but those of different files interleave. A failed file doesn't stop the others,
+// the returned error lists every file that failed. It returns the total number of matching lines.
+func GrepPrefix(ctx context.Context, bucketName, prefix string, re *regexp.Regexp, concurrency int, w io.Writer) (int, error) {
+	var (
+		mu      sync.Mutex
+		matches int
+	)
+	err := ProcessPrefix(ctx, bucketName, prefix, concurrency, func(attrs *storage.ObjectAttrs, r io.Reader) error {
+		_, err := grepLines(r, re, func(line []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			matches++
+			_, err := fmt.Fprintf(w, "%s:%s\n", attrs.Name, line)
+			return err
+		})
+		return err
+	})
+	return matches, err
+}
+
+// grepLines calls emit with each line of r, gzipped or not, matching re, and returns their count
+func grepLines(r io.Reader, re *regexp.Regexp, emit func(line []byte) error) (matches int, err error) {
+	src, err := maybeGunzip(r)
+	if err != nil {
+		return 0, err
+	}
+	scanner := newLineScanner(src)
+	for scanner.Scan() {
+		if !re.Match(scanner.Bytes()) {
+			continue
+		}
+		matches++
+		if err := emit(scanner.Bytes()); err != nil {
+			return matches, err
+		}
+	}
+	return matches, scanner.Err()
+}
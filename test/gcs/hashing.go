@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// hashing.go defines the optional object name hashing used to spread load across gcs
+
+package gcs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+)
+
+// keyHashLength is the number of hash characters prepended to object names, 0 means disabled
+var keyHashLength int
+
+// EnableKeyHashing makes all functions of this package store and read objects under
+// "<hash>/<key>" instead of "<key>", where hash is the first length hex characters of the md5 of key.
+// Spreading sequential keys (e.g. timestamps) across the key space avoids gcs hotspotting
+// on high write rate buckets, at the cost of human readable object names and of ordered and
+// prefix listing: listing prefixes match the stored names, hash included, and results come in
+// hash order. Listing functions still return the original keys, not the hashed names.
+// A length of 0 disables hashing. Like Authenticate, it should be called before any other function.
+func EnableKeyHashing(length int) {
+	if length < 0 {
+		length = 0
+	}
+	if length > 2*md5.Size {
+		length = 2 * md5.Size
+	}
+	keyHashLength = length
+}
+
+// HashedKey returns the object name key is stored under
+func HashedKey(key string) string {
+	if keyHashLength == 0 {
+		return key
+	}
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:keyHashLength] + "/" + key
+}
+
+// UnhashKey resolves an object name obtained outside of this package, e.g. from gsutil or a
+// notification, back to the key it was written with. Functions of this package return keys already.
+func UnhashKey(name string) string {
+	if keyHashLength == 0 {
+		return name
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || HashedKey(parts[1]) != name {
+		return name
+	}
+	return parts[1]
+}
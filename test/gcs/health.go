@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// health.go defines health checks of gcs buckets
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds the check of each bucket
+const healthCheckTimeout = 5 * time.Second
+
+// BucketHealth is the result of checking a bucket
+type BucketHealth struct {
+	Bucket string `json:"bucket"`
+	// Reachable tells if the bucket attrs could be read
+	Reachable bool `json:"reachable"`
+	// Latency is the round-trip time of the check, even if it failed
+	Latency time.Duration `json:"latency"`
+	// Error is why the bucket isn't reachable
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport is the result of Health, with the buckets in the order they were given
+type HealthReport struct {
+	Buckets []BucketHealth `json:"buckets"`
+}
+
+// Health checks all buckets concurrently, with a single request reading the attrs of each,
+// bounded by a 5s timeout, and reports their reachability and latency, e.g. for a readiness
+// probe. The report is always complete, the returned error lists the buckets unreachable.
+func Health(ctx context.Context, buckets []string) (HealthReport, error) {
+	report := HealthReport{Buckets: make([]BucketHealth, len(buckets))}
+	var wg sync.WaitGroup
+	for i, bucketName := range buckets {
+		wg.Add(1)
+		go func(i int, bucketName string) {
+			defer wg.Done()
+			report.Buckets[i] = checkBucket(ctx, bucketName)
+		}(i, bucketName)
+	}
+	wg.Wait()
+
+	var failures []string
+	for _, h := range report.Buckets {
+		if !h.Reachable {
+			failures = append(failures, fmt.Sprintf("%s: %s", h.Bucket, h.Error))
+		}
+	}
+	if len(failures) > 0 {
+		return report, fmt.Errorf("%d of %d buckets unreachable: %s", len(failures), len(buckets), strings.Join(failures, "; "))
+	}
+	return report, nil
+}
+
+// checkBucket times reading the attrs of the bucket
+func checkBucket(ctx context.Context, bucketName string) BucketHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Bucket(bucketName).Attrs(ctx)
+	h := BucketHealth{Bucket: bucketName, Reachable: err == nil, Latency: time.Since(start)}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	return h
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// heartbeat.go defines heartbeats telling crashed uploaders from slow ones
+
+package gcs
+
+import (
+	"context"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// HeartbeatFile is the name of the heartbeat file written under an upload prefix
+const HeartbeatFile = ".heartbeat"
+
+// StartHeartbeat writes prefix/.heartbeat right away, then rewrites it every interval until
+// ctx is done or the returned stop function is called, which also deletes it. Uploaders
+// call it before a long upload under prefix and stop it once the upload is complete,
+// so that consumers can tell with IsUploadStale whether the uploader is still alive.
+func StartHeartbeat(ctx context.Context, bucketName, prefix string, interval time.Duration) (stop func()) {
+	heartbeatPath := path.Join(prefix, HeartbeatFile)
+	temps := newTempObjects(bucketName)
+	handle, err := createDestinationObject(bucketName, temps.add(heartbeatPath))
+	if err != nil {
+		log.Printf("Failed writing heartbeat %q: %v", heartbeatPath, err)
+		return func() {}
+	}
+	attrs := &storage.ObjectAttrs{ContentType: "text/plain"}
+	beat := func() {
+		data := []byte(time.Now().UTC().Format(time.RFC3339))
+		if _, err := writeObject(ctx, handle, data, attrs); err != nil {
+			log.Printf("Failed writing heartbeat %q: %v", heartbeatPath, err)
+		}
+	}
+	beat()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				beat()
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			temps.cleanup()
+		})
+	}
+}
+
+// IsUploadStale checks if the upload under prefix is in progress but its uploader stopped
+// sending heartbeats for longer than staleAfter, likely because it crashed.
+// Prefixes without heartbeat file, either never uploaded with a heartbeat or completely
+// uploaded, aren't stale. The age is measured from the gcs update time of the heartbeat file.
+func IsUploadStale(ctx context.Context, bucketName, prefix string, staleAfter time.Duration) (bool, error) {
+	attrs, err := createStorageObject(bucketName, path.Join(prefix, HeartbeatFile)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(attrs.Updated) > staleAfter, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// indexhtml.go defines functions making gcs directories browsable
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// IndexHTML is the name of the file GenerateIndexHTML writes
+const IndexHTML = "index.html"
+
+// indexEntry is a row of a generated index.html
+type indexEntry struct {
+	Name    string
+	URL     string
+	Size    int64
+	Updated string
+	IsDir   bool
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Updated</th></tr>
+{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.Updated}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// GenerateIndexHTML lists the direct children of prefix and uploads an index.html in it, linking
+// each file with its size and update time, and each subdirectory to its own index.html.
+// Links are public URLs, so the files must be publicly readable for the page to be useful.
+func GenerateIndexHTML(ctx context.Context, bucketName, prefix string) error {
+	dir := dirPrefix(prefix)
+	var entries []indexEntry
+	err := iterateObjects(ctx, bucketName, dir, "/", func(attrs *storage.ObjectAttrs) error {
+		if attrs.Prefix != "" {
+			name := strings.TrimPrefix(attrs.Prefix, dir)
+			entries = append(entries, indexEntry{
+				Name:  name,
+				URL:   name + IndexHTML,
+				IsDir: true,
+			})
+			return nil
+		}
+		name := strings.TrimPrefix(attrs.Name, dir)
+		if name == IndexHTML || name == "" {
+			return nil
+		}
+		entries = append(entries, indexEntry{
+			Name:    name,
+			URL:     PublicURL(bucketName, attrs.Name),
+			Size:    attrs.Size,
+			Updated: attrs.Updated.UTC().Format(time.RFC3339),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var page bytes.Buffer
+	data := struct {
+		Title   string
+		Entries []indexEntry
+	}{gcsScheme + bucketName + "/" + dir, entries}
+	if err := indexTemplate.Execute(&page, data); err != nil {
+		return err
+	}
+	handle, err := createDestinationObject(bucketName, path.Join(dir, IndexHTML))
+	if err != nil {
+		return err
+	}
+	_, err = writeObject(ctx, handle, page.Bytes(), &storage.ObjectAttrs{ContentType: "text/html; charset=utf-8"})
+	return err
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// keyprefix.go defines the optional key prefix scoping all operations to a subtree of the buckets
+
+package gcs
+
+import (
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// keyPrefix is prepended to all object names, "" means disabled
+var keyPrefix string
+
+// SetKeyPrefix scopes all functions of this package to the objects under prefix, e.g. "tenant-a/":
+// paths passed to them are relative to prefix, which is prepended to form object names, and
+// listing results are stripped of it. The prefix is prepended as is, so it usually ends with "/".
+// Key hashing, if enabled, applies to the relative path, after prefix.
+// Like Authenticate, it should be called before any other function.
+func SetKeyPrefix(prefix string) {
+	keyPrefix = prefix
+}
+
+// objectName returns the gcs object name of path
+func objectName(path string) string {
+	return keyPrefix + HashedKey(path)
+}
+
+// relativeName resolves a gcs object name back to the path it was written with
+func relativeName(name string) string {
+	return UnhashKey(strings.TrimPrefix(name, keyPrefix))
+}
+
+// scopedQuery returns a copy of q listing under the key prefix
+func scopedQuery(q *storage.Query) *storage.Query {
+	scoped := *q
+	scoped.Prefix = keyPrefix + q.Prefix
+	return &scoped
+}
+
+// resolveNames turns the names of listing results back into paths
+func resolveNames(attrs *storage.ObjectAttrs) {
+	attrs.Name = relativeName(attrs.Name)
+	attrs.Prefix = strings.TrimPrefix(attrs.Prefix, keyPrefix)
+}
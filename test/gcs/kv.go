@@ -0,0 +1,188 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kv.go defines a tiny key-value store backed by a single gcs JSON file
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// kvMaxAttempts is the number of read-modify-write attempts before giving up on conflicts
+	kvMaxAttempts = 10
+	// kvRetryDelay is the delay before the first retry, doubled on each retry
+	kvRetryDelay = 100 * time.Millisecond
+)
+
+// The KV functions keep a JSON map of strings in the file at filePath. Writes are
+// read-modify-write cycles guarded by the generation read, retried on conflicts, so concurrent
+// writers never lose each other's changes. GCS sustains about one write per second to a single
+// file, so this only suits a few writers updating rarely; heavy contention exhausts the retries.
+
+// KVGet returns the value of key, and whether it was set
+func KVGet(ctx context.Context, bucketName, filePath, key string) (string, bool, error) {
+	m, _, err := readKV(ctx, createStorageObject(bucketName, filePath))
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := m[key]
+	return value, ok, nil
+}
+
+// KVSet sets key to value
+func KVSet(ctx context.Context, bucketName, filePath, key, value string) error {
+	return updateKV(ctx, bucketName, filePath, func(m map[string]string) {
+		m[key] = value
+	})
+}
+
+// KVDelete removes key, deleting a key that isn't set is not an error
+func KVDelete(ctx context.Context, bucketName, filePath, key string) error {
+	return updateKV(ctx, bucketName, filePath, func(m map[string]string) {
+		delete(m, key)
+	})
+}
+
+// readKV reads the map and the generation it was read at, 0 if the file doesn't exist yet
+func readKV(ctx context.Context, handle *storage.ObjectHandle) (map[string]string, int64, error) {
+	contents, generation, err := readCurrent(ctx, handle)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := decodeKV(handle, contents)
+	return m, generation, err
+}
+
+// decodeKV parses the content of a key-value file, nil content being an empty map
+func decodeKV(handle *storage.ObjectHandle, contents []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	if contents == nil {
+		return m, nil
+	}
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("invalid key-value file %q: %v", relativeName(handle.ObjectName()), err)
+	}
+	return m, nil
+}
+
+// updateKV applies fn to the map and writes it back, retrying if another writer got there first
+func updateKV(ctx context.Context, bucketName, filePath string, fn func(map[string]string)) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	return updateObject(ctx, handle, "application/json", func(contents []byte) ([]byte, error) {
+		m, err := decodeKV(handle, contents)
+		if err != nil {
+			return nil, err
+		}
+		fn(m)
+		return json.Marshal(m)
+	})
+}
+
+// readCurrent reads the file and the generation it was read at, nil and 0 if it doesn't exist yet.
+// If another writer replaces or deletes the file between reading its generation and its content,
+// the generation is gone, so the read starts over with the new one.
+func readCurrent(ctx context.Context, handle *storage.ObjectHandle) ([]byte, int64, error) {
+	for attempt := 1; ; attempt++ {
+		attrs, err := handle.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		contents, err := readGeneration(ctx, handle, attrs.Generation)
+		if err == storage.ErrObjectNotExist {
+			if attempt < kvMaxAttempts {
+				continue
+			}
+			return nil, 0, fmt.Errorf("too much contention on %q, gave up after %d attempts", relativeName(handle.ObjectName()), attempt)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return contents, attrs.Generation, nil
+	}
+}
+
+// updateObject replaces the content of the file with what fn returns for its current content,
+// nil if it doesn't exist yet. The write is conditioned on the generation read, and the whole
+// cycle is retried with exponential backoff when another writer got there first, whether it
+// replaced the file before the read completed or before the write.
+func updateObject(ctx context.Context, handle *storage.ObjectHandle, contentType string, fn func([]byte) ([]byte, error)) error {
+	delay := kvRetryDelay
+	for attempt := 1; ; attempt++ {
+		current, generation, err := readCurrent(ctx, handle)
+		if err != nil {
+			return err
+		}
+		contents, err := fn(current)
+		if err != nil {
+			return err
+		}
+		_, ok, err := compareAndSwap(ctx, handle, generation, contents, &storage.ObjectAttrs{ContentType: contentType})
+		if ok || err != nil {
+			return err
+		}
+		if attempt == kvMaxAttempts {
+			return fmt.Errorf("too much contention on %q, gave up after %d attempts", relativeName(handle.ObjectName()), attempt)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// CompareAndSwap replaces the content of filePath with newData only if its current generation is
+// expectedGen, 0 meaning the file must not exist yet, and returns the generation written.
+// If the generation doesn't match, ok is false and err nil, so callers can read the file again
+// and retry. The content type is inferred from the file extension.
+func CompareAndSwap(ctx context.Context, bucketName, filePath string, expectedGen int64, newData []byte) (newGen int64, ok bool, err error) {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return 0, false, err
+	}
+	attrs := &storage.ObjectAttrs{ContentType: inferContentType(filePath)}
+	return compareAndSwap(ctx, handle, expectedGen, newData, attrs)
+}
+
+// compareAndSwap is CompareAndSwap on a handle, with the given attrs
+func compareAndSwap(ctx context.Context, handle *storage.ObjectHandle, expectedGen int64, data []byte, attrs *storage.ObjectAttrs) (int64, bool, error) {
+	conds := storage.Conditions{GenerationMatch: expectedGen}
+	if expectedGen == 0 {
+		conds = storage.Conditions{DoesNotExist: true}
+	}
+	written, err := writeObject(ctx, handle.If(conds), data, attrs)
+	if isPreconditionFailed(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return written.Generation, true, nil
+}
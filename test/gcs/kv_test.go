@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestKVSetInterleaved(t *testing.T) {
+	tests := []struct {
+		name string
+		// other runs once, when KVSet of "a" first sends a request to method and path
+		request string
+		other   func(m *memGCS) error
+		want    map[string]string
+	}{
+		{
+			name:    "replaced while read",
+			request: http.MethodGet + " /bucket/kv.json",
+			other:   func(*memGCS) error { return KVSet(context.Background(), "bucket", "kv.json", "b", "2") },
+			want:    map[string]string{"a": "1", "b": "2"},
+		},
+		{
+			name:    "deleted while read",
+			request: http.MethodGet + " /bucket/kv.json",
+			other:   func(m *memGCS) error { m.remove("kv.json"); return nil },
+			want:    map[string]string{"a": "1"},
+		},
+		{
+			name:    "replaced before write",
+			request: http.MethodPost + " /storage/v1/b/bucket/o",
+			other:   func(*memGCS) error { return KVSet(context.Background(), "bucket", "kv.json", "b", "2") },
+			want:    map[string]string{"a": "1", "b": "2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			m.put("kv.json", []byte(`{}`))
+			interleaved := false
+			m.before = func(r *http.Request) {
+				if interleaved || r.Method+" "+r.URL.Path != test.request {
+					return
+				}
+				interleaved = true
+				if err := test.other(m); err != nil {
+					t.Errorf("Interleaved writer failed: %v", err)
+				}
+			}
+
+			if err := KVSet(context.Background(), "bucket", "kv.json", "a", "1"); err != nil {
+				t.Fatalf("KVSet() = %v", err)
+			}
+			if !interleaved {
+				t.Fatalf("KVSet() sent no %s request", test.request)
+			}
+			data, _ := m.get("kv.json")
+			var got map[string]string
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Invalid key-value file %q: %v", data, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Key-value file = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
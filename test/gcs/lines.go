@@ -0,0 +1,255 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// lines.go defines functions reading and writing gcs text files line by line
+
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// firstLineChunkSize is the number of bytes ReadFirstLine reads at a time
+	firstLineChunkSize = 4 * 1024
+	// ScanProgressLines is the number of lines between two progress calls of ScanLines
+	ScanProgressLines = 10000
+)
+
+// ReadFirstLine returns the first line of the file, without its line ending, by range-reading
+// small chunks until a newline is found, so only a few bytes are downloaded for format sniffing.
+// Lines longer than maxLineSize are rejected.
+func ReadFirstLine(ctx context.Context, bucketName, filePath string) (string, error) {
+	handle := createStorageObject(bucketName, filePath)
+	var line []byte
+	for offset := int64(0); offset < maxLineSize; offset += firstLineChunkSize {
+		r, err := handle.NewRangeReader(ctx, offset, firstLineChunkSize)
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusRequestedRangeNotSatisfiable && offset == 0 {
+			// gcs refuses ranges of empty files.
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		chunk, err := ioutil.ReadAll(limitByBudget(ctx, r))
+		size := r.Size()
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+			return strings.TrimSuffix(string(append(line, chunk[:i]...)), "\r"), nil
+		}
+		line = append(line, chunk...)
+		if offset+int64(len(chunk)) >= size {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+	}
+	return "", fmt.Errorf("first line of %q is longer than %d bytes", filePath, maxLineSize)
+}
+
+// ScanLines streams the file and calls fn with each of its lines, without line ending, stopping
+// at the first error fn returns. gzip compressed files are decompressed transparently.
+// If progress isn't nil, it's called with the number of lines processed so far every
+// ScanProgressLines lines, and with the total at the end if it wasn't just reported.
+// Scanning stops with ctx's error once ctx is done. Lines longer than maxLineSize are rejected.
+func ScanLines(ctx context.Context, bucketName, filePath string, fn func(line string) error, progress func(lines int64)) error {
+	ctx, stalls, stop := watchStalls(ctx)
+	defer stop()
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return stalls.err(err)
+	}
+	defer f.Close()
+	src, err := maybeGunzip(stalls.wrap(limitByBudget(ctx, f)))
+	if err != nil {
+		return err
+	}
+	scanner := newLineScanner(src)
+	var lines int64
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return stalls.err(err)
+		}
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+		lines++
+		if progress != nil && lines%ScanProgressLines == 0 {
+			progress(lines)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stalls.err(err)
+	}
+	if progress != nil && lines%ScanProgressLines != 0 {
+		progress(lines)
+	}
+	return nil
+}
+
+// StreamTail returns the last lines lines of the file, or all of them if it has fewer, without
+// line endings. The whole file is streamed once, keeping only the last lines in memory, so it
+// costs a full download: it's meant for moderate-size logs, including still growing ones.
+func StreamTail(ctx context.Context, bucketName, filePath string, lines int) ([]string, error) {
+	if lines < 1 {
+		return nil, fmt.Errorf("invalid number of lines %d", lines)
+	}
+	ring := make([]string, 0, lines)
+	next := 0
+	err := ScanLines(ctx, bucketName, filePath, func(line string) error {
+		if len(ring) < lines {
+			ring = append(ring, line)
+		} else {
+			ring[next] = line
+		}
+		next = (next + 1) % lines
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ring) < lines {
+		return ring, nil
+	}
+	// The oldest line kept is the next one to be overwritten.
+	return append(ring[next:], ring[:next]...), nil
+}
+
+// TruncateToTail replaces the file with its last keepBytes bytes at most, starting at a line
+// boundary so no partial line is kept, e.g. to bound the size of a growing log.
+// GCS files are immutable, so this rewrites the file, keeping its editable attributes; the new
+// content is streamed, not held in memory. Files of keepBytes or less are left as they are, and
+// the rewrite fails if the file changed since it was read. gzip encoded files are rejected, as
+// their tail can't be read without decompressing them whole.
+func TruncateToTail(ctx context.Context, bucketName, filePath string, keepBytes int64) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if attrs.Size <= keepBytes {
+		return nil
+	}
+	if attrs.ContentEncoding == "gzip" {
+		return fmt.Errorf("cannot truncate gzip encoded file %q", filePath)
+	}
+	// The byte before the tail tells if the tail starts at a line boundary.
+	start := attrs.Size - keepBytes
+	src, err := handle.Generation(attrs.Generation).NewRangeReader(ctx, start-1, keepBytes+1)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	br := bufio.NewReader(limitByBudget(ctx, src))
+	prev, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if prev != '\n' {
+		if err := skipLine(br); err != nil {
+			return err
+		}
+	}
+
+	dst := newProfiledWriter(ctx, handle.If(storage.Conditions{GenerationMatch: attrs.Generation}))
+	keepEditableAttrs(&dst.ObjectAttrs, attrs)
+	if _, err := io.Copy(dst, br); err != nil {
+		dst.CloseWithError(err)
+		return err
+	}
+	return dst.Close()
+}
+
+// skipLine discards everything up to and including the next newline, or to the end
+func skipLine(br *bufio.Reader) error {
+	for {
+		_, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
+
+// UploadDedupedLines uploads the lines of r to dstPath, collapsing runs of consecutive identical
+// lines into a single "<line> (xN)" line, e.g. for repetitive logs. r is streamed, only the
+// current line is held in memory. Lines are written with "\n" endings, and lines longer than
+// maxLineSize are rejected.
+func UploadDedupedLines(ctx context.Context, bucketName, dstPath string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(dedupeLines(pw, r))
+	}()
+	err := UploadReader(ctx, bucketName, dstPath, pr)
+	// Unblocks dedupeLines if the upload stopped reading early.
+	pr.Close()
+	return err
+}
+
+// dedupeLines writes the lines of r to w, collapsing runs of consecutive identical lines
+func dedupeLines(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	var prev string
+	count := 0
+	writeRun := func() error {
+		var err error
+		switch {
+		case count == 1:
+			_, err = fmt.Fprintf(bw, "%s\n", prev)
+		case count > 1:
+			_, err = fmt.Fprintf(bw, "%s (x%d)\n", prev, count)
+		}
+		return err
+	}
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if count > 0 && line == prev {
+			count++
+			continue
+		}
+		if err := writeRun(); err != nil {
+			return err
+		}
+		prev, count = line, 1
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := writeRun(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDedupeLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"single line", "a\n", "a\n"},
+		{"no final newline", "a\na", "a (x2)\n"},
+		{"distinct lines", "a\nb\nc\n", "a\nb\nc\n"},
+		{"run", "a\na\na\n", "a (x3)\n"},
+		{"runs", "a\na\nb\nc\nc\n", "a (x2)\nb\nc (x2)\n"},
+		{"non-consecutive", "a\nb\na\n", "a\nb\na\n"},
+		{"empty lines", "\n\n\na\n", " (x3)\na\n"},
+		{"CRLF", "a\r\na\r\n", "a (x2)\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got bytes.Buffer
+			if err := dedupeLines(&got, strings.NewReader(test.input)); err != nil {
+				t.Fatalf("dedupeLines() = %v", err)
+			}
+			if got.String() != test.want {
+				t.Errorf("dedupeLines(%q) = %q, want %q", test.input, got.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestDedupeLinesTooLong(t *testing.T) {
+	input := strings.Repeat("x", maxLineSize+1)
+	var got bytes.Buffer
+	if err := dedupeLines(&got, strings.NewReader(input)); err == nil {
+		t.Errorf("dedupeLines() of a %d bytes line = nil, want an error", len(input))
+	}
+}
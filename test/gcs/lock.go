@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// lock.go defines a best-effort lock backed by a gcs object
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrLockHeld is returned by AcquireLock when the lock object is held by someone else
+var ErrLockHeld = errors.New("gcs: lock is held by another owner")
+
+// AcquireLock creates the lock object lockPath, failing with ErrLockHeld if it already exists.
+// If the existing lock was last updated more than ttl ago it is considered stale and is reclaimed,
+// a ttl of 0 disables reclaiming. The returned release func deletes the lock, but only if
+// it's still the generation this call created.
+// This is a best-effort coordination primitive, not a true consensus lock: a holder
+// running longer than ttl may have its lock reclaimed while it still thinks it holds it.
+func AcquireLock(ctx context.Context, bucketName, lockPath string, ttl time.Duration) (release func() error, err error) {
+	handle, err := createDestinationObject(bucketName, lockPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	attrs, err := createLockObject(ctx, handle)
+	if err == ErrLockHeld && ttl > 0 {
+		// Reclaim the lock if it's stale, the generation precondition makes sure
+		// only one contender gets to delete it.
+		held, attrsErr := handle.Attrs(ctx)
+		switch {
+		case attrsErr == storage.ErrObjectNotExist:
+			attrs, err = createLockObject(ctx, handle)
+		case attrsErr != nil:
+			return nil, attrsErr
+		case time.Since(held.Updated) > ttl:
+			delErr := handle.If(storage.Conditions{GenerationMatch: held.Generation}).Delete(ctx)
+			if delErr != nil && !isPreconditionFailed(delErr) && delErr != storage.ErrObjectNotExist {
+				return nil, delErr
+			}
+			attrs, err = createLockObject(ctx, handle)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	release = func() error {
+		err := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(context.Background())
+		if isPreconditionFailed(err) || err == storage.ErrObjectNotExist {
+			return fmt.Errorf("lock %q was reclaimed by another owner", lockPath)
+		}
+		return err
+	}
+	return release, nil
+}
+
+// createLockObject writes the lock object only if it doesn't exist yet
+func createLockObject(ctx context.Context, handle *storage.ObjectHandle) (*storage.ObjectAttrs, error) {
+	host, _ := os.Hostname()
+	w := newProfiledWriter(ctx, handle.If(storage.Conditions{DoesNotExist: true}))
+	w.ContentType = "text/plain"
+	fmt.Fprintf(w, "host=%s pid=%d acquired=%s\n", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return nil, ErrLockHeld
+		}
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+// isPreconditionFailed checks if err is gcs rejecting a request because of its Conditions
+func isPreconditionFailed(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// manifest.go defines dated manifests snapshotting the files under a gcs prefix
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// manifestDir is the directory holding the manifests of a prefix
+	manifestDir = ".manifests"
+	// manifestDateLayout is the date format of manifest names, one manifest per day
+	manifestDateLayout = "2006-01-02"
+)
+
+// ManifestEntry is a file listed in a Manifest
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	CRC32C uint32 `json:"crc32c"`
+}
+
+// Manifest is a snapshot of the files under a prefix
+type Manifest struct {
+	Date       string          `json:"date"`
+	TotalBytes int64           `json:"totalBytes"`
+	Entries    []ManifestEntry `json:"entries"`
+}
+
+// datedManifestPath returns the path of the manifest of prefix for the day of date
+func datedManifestPath(prefix string, date time.Time) string {
+	return path.Join(prefix, manifestDir, date.UTC().Format(manifestDateLayout)+".json")
+}
+
+// WriteManifest lists the files under prefix and writes their names, sizes and checksums to the
+// manifest of prefix for the day of date, in UTC, replacing any manifest of that day.
+// Manifests are stored under prefix/.manifests/, which is left out of the listing.
+// It returns the path of the manifest.
+func WriteManifest(ctx context.Context, bucketName, prefix string, date time.Time) (string, error) {
+	excluded := dirPrefix(path.Join(prefix, manifestDir))
+	m := Manifest{Date: date.UTC().Format(manifestDateLayout), Entries: []ManifestEntry{}}
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if strings.HasPrefix(attrs.Name, excluded) {
+			return nil
+		}
+		m.Entries = append(m.Entries, ManifestEntry{Name: attrs.Name, Size: attrs.Size, CRC32C: attrs.CRC32C})
+		m.TotalBytes += attrs.Size
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	contents, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	p := datedManifestPath(prefix, date)
+	handle, err := createDestinationObject(bucketName, p)
+	if err != nil {
+		return "", err
+	}
+	attrs := &storage.ObjectAttrs{ContentType: "application/json"}
+	if _, err := writeObject(ctx, handle, contents, attrs); err != nil {
+		return "", fmt.Errorf("failed writing manifest %q: %v", p, err)
+	}
+	return p, nil
+}
+
+// ReadManifest reads the manifest of prefix for the day of date, in UTC.
+// ErrNotFound is returned if no manifest was written that day.
+func ReadManifest(ctx context.Context, bucketName, prefix string, date time.Time) (*Manifest, error) {
+	return readManifestAt(ctx, bucketName, datedManifestPath(prefix, date))
+}
+
+// readManifestAt reads the manifest stored at p
+func readManifestAt(ctx context.Context, bucketName, p string) (*Manifest, error) {
+	contents, err := Read(ctx, bucketName, p)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %q: %v", p, err)
+	}
+	return &m, nil
+}
+
+// GrowthRate returns the total size of the files under prefix at each of snapshots, from the
+// manifests written by WriteManifest on those days, for trend analysis. Days without manifest
+// get a size of -1 rather than failing the whole series.
+func GrowthRate(ctx context.Context, bucketName, prefix string, snapshots []time.Time) ([]int64, error) {
+	sizes := make([]int64, len(snapshots))
+	for i, date := range snapshots {
+		m, err := ReadManifest(ctx, bucketName, prefix, date)
+		if err == ErrNotFound {
+			sizes[i] = -1
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = m.TotalBytes
+	}
+	return sizes, nil
+}
+
+// VerifyAgainstManifest compares the files currently under prefix with the manifest stored at
+// manifestPath, by name, size and CRC32C, e.g. to detect tampering or incomplete writes since
+// the manifest was written. It returns the sorted names of files in the manifest but gone
+// (missing), of files whose content differs (changed), and of files not in the manifest (extra).
+// The manifests directory of prefix is left out of the listing.
+func VerifyAgainstManifest(ctx context.Context, bucketName, prefix, manifestPath string) (missing, changed, extra []string, err error) {
+	m, err := readManifestAt(ctx, bucketName, manifestPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	expected := make(map[string]ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		expected[e.Name] = e
+	}
+	excluded := dirPrefix(path.Join(prefix, manifestDir))
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if strings.HasPrefix(attrs.Name, excluded) {
+			return nil
+		}
+		e, ok := expected[attrs.Name]
+		if !ok {
+			extra = append(extra, attrs.Name)
+			return nil
+		}
+		delete(expected, attrs.Name)
+		if e.Size != attrs.Size || e.CRC32C != attrs.CRC32C {
+			changed = append(changed, attrs.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for name := range expected {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	// Listings come in hash order with key hashing.
+	sort.Strings(changed)
+	sort.Strings(extra)
+	return missing, changed, extra, nil
+}
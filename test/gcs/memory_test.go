@@ -0,0 +1,316 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// memObject is a file stored by memGCS
+type memObject struct {
+	data        []byte
+	generation  int64
+	contentType string
+	metadata    map[string]string
+}
+
+// memGCS is an in-memory gcs of a single bucket without versioning, serving the JSON API calls
+// used to list, stat, write, compose, copy and delete files, and the XML API downloads
+type memGCS struct {
+	*fakeGCS
+	mu         sync.Mutex
+	objects    map[string]*memObject
+	generation int64
+	// before, if set, is called before serving each request
+	before func(r *http.Request)
+}
+
+// newMemGCS starts an empty memGCS and points the gcs package at it, downloads included
+func newMemGCS(t *testing.T) *memGCS {
+	m := &memGCS{objects: make(map[string]*memObject)}
+	m.fakeGCS = newFakeGCS(t, m.serve)
+	// Downloads always go to storage.googleapis.com, so send every request to the server instead.
+	hc := &http.Client{Transport: redirectTransport{to: m.URL}}
+	err := AuthenticateWithOptions(context.Background(), option.WithHTTPClient(hc), option.WithEndpoint(m.URL+"/storage/v1/"))
+	if err != nil {
+		m.Close()
+		t.Fatalf("Failed to authenticate with the fake server: %v", err)
+	}
+	return m
+}
+
+// redirectTransport sends all requests to the server at URL to
+type redirectTransport struct {
+	to string
+}
+
+func (rt redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	to, err := url.Parse(rt.to)
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(r.Context())
+	u := *r.URL
+	u.Scheme, u.Host = to.Scheme, to.Host
+	r.URL = &u
+	r.Host = to.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// put stores data under name as a new generation
+func (m *memGCS) put(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generation++
+	m.objects[name] = &memObject{data: data, generation: m.generation}
+}
+
+// remove deletes name
+func (m *memGCS) remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+}
+
+// get returns the content of name, and whether it exists
+func (m *memGCS) get(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+func (m *memGCS) serve(w http.ResponseWriter, r *http.Request) {
+	if m.before != nil {
+		m.before(r)
+	}
+	const objectsPath = "/storage/v1/b/bucket/o"
+	switch p := r.URL.Path; {
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "multipart":
+		m.upload(w, r)
+	case r.Method == http.MethodGet && p == objectsPath:
+		m.list(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(p, objectsPath+"/") && strings.HasSuffix(p, "/compose"):
+		m.compose(w, r, strings.TrimSuffix(strings.TrimPrefix(p, objectsPath+"/"), "/compose"))
+	case r.Method == http.MethodPost && strings.Contains(p, "/rewriteTo/b/bucket/o/"):
+		names := strings.SplitN(strings.TrimPrefix(p, objectsPath+"/"), "/rewriteTo/b/bucket/o/", 2)
+		m.rewrite(w, r, names[0], names[1])
+	case strings.HasPrefix(p, objectsPath+"/"):
+		m.object(w, r, strings.TrimPrefix(p, objectsPath+"/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/bucket/"):
+		m.download(w, r, strings.TrimPrefix(p, "/bucket/"))
+	default:
+		http.Error(w, `{"error": {"code": 400, "message": "unsupported request"}}`, http.StatusBadRequest)
+	}
+}
+
+// attrsJSON is the JSON API resource of o
+func attrsJSON(name string, o *memObject) map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":      "bucket",
+		"name":        name,
+		"generation":  strconv.FormatInt(o.generation, 10),
+		"size":        strconv.Itoa(len(o.data)),
+		"contentType": o.contentType,
+		"metadata":    o.metadata,
+	}
+}
+
+// fail answers with a JSON API error
+func fail(w http.ResponseWriter, code int) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": http.StatusText(code)},
+	})
+}
+
+func (m *memGCS) list(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.objects {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := []map[string]interface{}{}
+	for _, name := range names {
+		items = append(items, attrsJSON(name, m.objects[name]))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (m *memGCS) object(w http.ResponseWriter, r *http.Request, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok {
+		fail(w, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(attrsJSON(name, o))
+	case http.MethodDelete:
+		if gen := r.URL.Query().Get("ifGenerationMatch"); gen != "" && gen != strconv.FormatInt(o.generation, 10) {
+			fail(w, http.StatusPreconditionFailed)
+			return
+		}
+		delete(m.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(w, http.StatusBadRequest)
+	}
+}
+
+func (m *memGCS) download(w http.ResponseWriter, r *http.Request, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok || (r.URL.Query().Get("generation") != "" && r.URL.Query().Get("generation") != strconv.FormatInt(o.generation, 10)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", o.contentType)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	w.Write(o.data)
+}
+
+// store saves o as the next generation of name, unless its current generation doesn't match the
+// ifGenerationMatch precondition of r. m.mu must be held.
+func (m *memGCS) store(r *http.Request, name string, o *memObject) bool {
+	var current int64
+	if existing, ok := m.objects[name]; ok {
+		current = existing.generation
+	}
+	if gen := r.URL.Query().Get("ifGenerationMatch"); gen != "" && gen != strconv.FormatInt(current, 10) {
+		return false
+	}
+	m.generation++
+	o.generation = m.generation
+	m.objects[name] = o
+	return true
+}
+
+// compose concatenates the source files into dst
+func (m *memGCS) compose(w http.ResponseWriter, r *http.Request, dst string) {
+	var req struct {
+		Destination struct {
+			ContentType string            `json:"contentType"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"destination"`
+		SourceObjects []struct {
+			Name       string `json:"name"`
+			Generation string `json:"generation"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(w, http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := &memObject{contentType: req.Destination.ContentType, metadata: req.Destination.Metadata}
+	for _, src := range req.SourceObjects {
+		s, ok := m.objects[src.Name]
+		if !ok || (src.Generation != "" && src.Generation != "0" && src.Generation != strconv.FormatInt(s.generation, 10)) {
+			fail(w, http.StatusNotFound)
+			return
+		}
+		o.data = append(o.data, s.data...)
+	}
+	if !m.store(r, dst, o) {
+		fail(w, http.StatusPreconditionFailed)
+		return
+	}
+	json.NewEncoder(w).Encode(attrsJSON(dst, o))
+}
+
+// rewrite copies src to dst in a single call
+func (m *memGCS) rewrite(w http.ResponseWriter, r *http.Request, src, dst string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.objects[src]
+	if gen := r.URL.Query().Get("sourceGeneration"); !ok || (gen != "" && gen != strconv.FormatInt(s.generation, 10)) {
+		fail(w, http.StatusNotFound)
+		return
+	}
+	o := &memObject{data: s.data, contentType: s.contentType, metadata: s.metadata}
+	if !m.store(r, dst, o) {
+		fail(w, http.StatusPreconditionFailed)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "resource": attrsJSON(dst, o)})
+}
+
+// upload stores a multipart upload, checking its ifGenerationMatch precondition
+func (m *memGCS) upload(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fail(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var parts [2][]byte
+	for i := range parts {
+		part, err := mr.NextPart()
+		if err != nil {
+			fail(w, http.StatusBadRequest)
+			return
+		}
+		if parts[i], err = ioutil.ReadAll(part); err != nil {
+			fail(w, http.StatusBadRequest)
+			return
+		}
+	}
+	var meta struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(parts[0], &meta); err != nil {
+		fail(w, http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := &memObject{data: parts[1], contentType: meta.ContentType, metadata: meta.Metadata}
+	if !m.store(r, meta.Name, o) {
+		fail(w, http.StatusPreconditionFailed)
+		return
+	}
+	json.NewEncoder(w).Encode(attrsJSON(meta.Name, o))
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// metadata.go defines functions inspecting and managing custom object metadata
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+)
+
+// IdempotencyKeyMetadata is the metadata key UploadIdempotent stores idempotency keys under
+const IdempotencyKeyMetadata = "idempotency-key"
+
+// ObjectsMissingMetadata lists all files under prefix and returns the ones
+// without the requiredKey custom metadata key.
+// Listing already returns each object's metadata, so no per-object Attrs calls are made.
+func ObjectsMissingMetadata(ctx context.Context, bucketName, prefix, requiredKey string) ([]string, error) {
+	var missing []string
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if _, ok := attrs.Metadata[requiredKey]; !ok {
+			missing = append(missing, attrs.Name)
+		}
+		return nil
+	})
+	return missing, err
+}
+
+// UploadIdempotent uploads local srcPath to dstPath tagged with idempotencyKey, unless dstPath
+// already exists with that same key, so that retries of the same upload don't replace it again.
+// It returns whether an upload happened.
+func UploadIdempotent(ctx context.Context, bucketName, dstPath, srcPath, idempotencyKey string) (bool, error) {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	attrs, err := handle.Attrs(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return false, err
+	}
+	conds := storage.Conditions{DoesNotExist: true}
+	if attrs != nil {
+		if attrs.Metadata[IdempotencyKeyMetadata] == idempotencyKey {
+			return false, nil
+		}
+		conds = storage.Conditions{GenerationMatch: attrs.Generation}
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	// The precondition makes concurrent duplicates fail instead of uploading twice.
+	dst := newProfiledWriter(ctx, handle.If(conds))
+	dst.ContentType = inferContentType(dstPath)
+	dst.Metadata = map[string]string{IdempotencyKeyMetadata: idempotencyKey}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.CloseWithError(err)
+		return false, err
+	}
+	if err := dst.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			if latest, attrsErr := handle.Attrs(ctx); attrsErr == nil && latest.Metadata[IdempotencyKeyMetadata] == idempotencyKey {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateMetadataPrefix sets the custom metadata keys of set on all files under prefix, running up
+// to concurrency updates at once, and returns the number of files updated. Other metadata keys
+// are kept, and files already having all of set are skipped. A failed update doesn't stop the
+// others, the returned error lists every file that failed.
+func UpdateMetadataPrefix(ctx context.Context, bucketName, prefix string, set map[string]string, concurrency int) (int, error) {
+	var (
+		updated  int64
+		mu       sync.Mutex
+		failures []string
+	)
+	err := forEachObjectParallel(ctx, bucketName, prefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		if hasMetadata(attrs, set) {
+			return nil
+		}
+		// Patching metadata merges the given keys into the existing ones.
+		handle, err := createDestinationObject(bucketName, attrs.Name)
+		if err == nil {
+			_, err = handle.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: set})
+		}
+		if err != nil {
+			mu.Lock()
+			failures = append(failures, fmt.Sprintf("%s: %v", attrs.Name, err))
+			mu.Unlock()
+			return nil
+		}
+		atomic.AddInt64(&updated, 1)
+		return nil
+	})
+	if err != nil {
+		return int(updated), err
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return int(updated), fmt.Errorf("failed updating metadata of %d files: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return int(updated), nil
+}
+
+// hasMetadata checks if all keys of set already have their value in the file metadata
+func hasMetadata(attrs *storage.ObjectAttrs, set map[string]string) bool {
+	for k, v := range set {
+		if got, ok := attrs.Metadata[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// metrics.go defines a prometheus collector exporting gcs storage usage
+
+package gcs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CollectorTarget is a gcs path whose usage is exported by a Collector
+type CollectorTarget struct {
+	Bucket string
+	Prefix string
+}
+
+// Collector is a prometheus.Collector exporting the number of files and total bytes
+// under a set of gcs paths as the gcs_objects_total and gcs_bytes_total gauges,
+// labeled with bucket and prefix. Values are refreshed by Run.
+type Collector struct {
+	targets  []CollectorTarget
+	interval time.Duration
+
+	objects    *prometheus.GaugeVec
+	bytes      *prometheus.GaugeVec
+	listErrors *prometheus.CounterVec
+}
+
+// NewCollector creates a Collector for targets, refreshed every interval once Run is called
+func NewCollector(targets []CollectorTarget, interval time.Duration) *Collector {
+	labels := []string{"bucket", "prefix"}
+	return &Collector{
+		targets:  targets,
+		interval: interval,
+		objects: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gcs_objects_total",
+			Help: "Number of gcs objects under the prefix.",
+		}, labels),
+		bytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gcs_bytes_total",
+			Help: "Total size in bytes of gcs objects under the prefix.",
+		}, labels),
+		listErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gcs_list_errors_total",
+			Help: "Number of failed listings of the prefix.",
+		}, labels),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.objects.Describe(ch)
+	c.bytes.Describe(ch)
+	c.listErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.objects.Collect(ch)
+	c.bytes.Collect(ch)
+	c.listErrors.Collect(ch)
+}
+
+// Run refreshes the gauges right away and then every interval, until ctx is done.
+// A failed listing is logged and counted in gcs_list_errors_total,
+// the target keeps its last successfully listed values.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update lists all targets and sets their gauges
+func (c *Collector) update(ctx context.Context) {
+	for _, t := range c.targets {
+		var objects, bytes int64
+		err := iterateObjects(ctx, t.Bucket, t.Prefix, "", func(attrs *storage.ObjectAttrs) error {
+			objects++
+			bytes += attrs.Size
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed listing gs://%s/%s: %v", t.Bucket, t.Prefix, err)
+			c.listErrors.WithLabelValues(t.Bucket, t.Prefix).Inc()
+			continue
+		}
+		c.objects.WithLabelValues(t.Bucket, t.Prefix).Set(float64(objects))
+		c.bytes.WithLabelValues(t.Bucket, t.Prefix).Set(float64(bytes))
+	}
+}
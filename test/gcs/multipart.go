@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// multipart.go defines functions uploading HTTP form files to gcs
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// UploadMultipart streams each file of the multipart form field of r to dstPrefix/<file name>,
+// without staging them in memory or on disk, and returns the gcs paths written.
+// The content type of each file is taken from its part headers.
+// Only the base name of the client supplied file name is used, and ".." is refused, so files
+// can't escape dstPrefix.
+func UploadMultipart(ctx context.Context, bucketName, dstPrefix string, r *http.Request, field string) ([]string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return paths, err
+		}
+		name := path.Base(strings.Replace(part.FileName(), "\\", "/", -1))
+		if part.FormName() != field || name == "" || name == "." || name == "/" {
+			part.Close()
+			continue
+		}
+		dstPath := path.Join(dstPrefix, name)
+		if name == ".." || !strings.HasPrefix(dstPath, dirPrefix(dstPrefix)) {
+			part.Close()
+			return paths, fmt.Errorf("refusing to upload %q outside %q", part.FileName(), dstPrefix)
+		}
+		handle, err := createDestinationObject(bucketName, dstPath)
+		if err != nil {
+			part.Close()
+			return paths, err
+		}
+		err = uploadPart(ctx, handle, part)
+		part.Close()
+		if err != nil {
+			return paths, fmt.Errorf("failed uploading %q: %v", part.FileName(), err)
+		}
+		paths = append(paths, dstPath)
+	}
+}
+
+// uploadPart streams part to handle, within the timeout of the bucket's profile
+func uploadPart(ctx context.Context, handle *storage.ObjectHandle, part *multipart.Part) error {
+	ctx, cancel := withBucketTimeout(ctx, handle.BucketName())
+	defer cancel()
+	dst := newProfiledWriter(ctx, handle)
+	dst.ContentType = part.Header.Get("Content-Type")
+	if _, err := io.Copy(dst, capUpload(part)); err != nil {
+		dst.CloseWithError(err)
+		return err
+	}
+	return dst.Close()
+}
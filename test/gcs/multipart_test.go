@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newUploadRequest returns a POST request of a multipart form with a file field "file" per name
+func newUploadRequest(t *testing.T, names ...string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range names {
+		w, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("Failed to create form file %q: %v", name, err)
+		}
+		fmt.Fprintf(w, "content of %s", name)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Failed to close multipart writer: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadMultipart(t *testing.T) {
+	f := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"bucket": "bucket", "name": "uploaded"}`)
+	})
+	defer f.Close()
+
+	paths, err := UploadMultipart(context.Background(), "bucket", "uploads", newUploadRequest(t, "a.txt", `dir\b.txt`, "../c.txt"), "file")
+	if err != nil {
+		t.Fatalf("UploadMultipart() = %v", err)
+	}
+	if want := []string{"uploads/a.txt", "uploads/b.txt", "uploads/c.txt"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("UploadMultipart() = %v, want %v", paths, want)
+	}
+	if got := len(f.requests()); got != 3 {
+		t.Errorf("Got %d requests, want 3", got)
+	}
+}
+
+func TestUploadMultipartEscape(t *testing.T) {
+	for _, name := range []string{"..", "a/..", `a\..`, "../.."} {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeGCS(t, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"bucket": "bucket", "name": "uploaded"}`)
+			})
+			defer f.Close()
+
+			paths, err := UploadMultipart(context.Background(), "bucket", "uploads/user", newUploadRequest(t, name), "file")
+			if err == nil {
+				t.Errorf("UploadMultipart() = %v, want an error", paths)
+			}
+			if got := f.requests(); len(got) != 0 {
+				t.Errorf("Got requests %v, want none", got)
+			}
+		})
+	}
+}
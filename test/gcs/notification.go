@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// notification.go defines functions managing gcs Pub/Sub notifications
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// CreateNotification makes the bucket publish a JSON message to the Pub/Sub topic, given as
+// "projects/<project>/topics/<topic>", for each of eventTypes (e.g. storage.ObjectFinalizeEvent)
+// on files starting with objectPrefix. Empty eventTypes means all events and empty objectPrefix
+// all files. It returns the ID of the notification.
+// The gcs service account of the project must be allowed to publish to the topic.
+func CreateNotification(ctx context.Context, bucketName, topic string, eventTypes []string, objectPrefix string) (string, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || parts[1] == "" || parts[3] == "" {
+		return "", fmt.Errorf("invalid topic %q: must be projects/<project>/topics/<topic>", topic)
+	}
+	n, err := client.Bucket(bucketName).AddNotification(ctx, &storage.Notification{
+		TopicProjectID:   parts[1],
+		TopicID:          parts[3],
+		EventTypes:       eventTypes,
+		ObjectNamePrefix: objectPrefix,
+		PayloadFormat:    storage.JSONPayload,
+	})
+	if err != nil {
+		return "", err
+	}
+	return n.ID, nil
+}
+
+// ListNotifications returns the notifications of the bucket, keyed by ID
+func ListNotifications(ctx context.Context, bucketName string) (map[string]*storage.Notification, error) {
+	return client.Bucket(bucketName).Notifications(ctx)
+}
+
+// DeleteNotification deletes the notification with given ID from the bucket
+func DeleteNotification(ctx context.Context, bucketName, id string) error {
+	return client.Bucket(bucketName).DeleteNotification(ctx, id)
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// parallel.go defines helpers running an operation on many gcs files concurrently
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// BatchOption configures ProcessPrefix and ReadMany
+type BatchOption func(*batchOptions)
+
+// batchOptions holds the settings of a single batch
+type batchOptions struct {
+	retryBudget time.Duration
+}
+
+// WithRetryBudget caps the total time all retries of the batch may wait, across all its files,
+// so that a few failing files can't drag the batch on. Once spent, failures of transient errors
+// aren't retried anymore. Without it, each file is retried as the bucket's retry policy says.
+func WithRetryBudget(total time.Duration) BatchOption {
+	return func(o *batchOptions) {
+		o.retryBudget = total
+	}
+}
+
+// batchContext applies opts to ctx
+func batchContext(ctx context.Context, opts []BatchOption) context.Context {
+	var o batchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.retryBudget > 0 {
+		ctx = withRetryBudget(ctx, o.retryBudget)
+	}
+	return ctx
+}
+
+// forEachObjectParallel lists files under prefix and calls fn for each of them, running up to
+// concurrency calls at once. The first error stops the listing and cancels the ctx passed to
+// running calls, it's returned once they all returned.
+func forEachObjectParallel(ctx context.Context, bucketName, prefix string, concurrency int,
+	fn func(ctx context.Context, attrs *storage.ObjectAttrs) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	listErr := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(ctx, attrs); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return listErr
+}
+
+// ProcessPrefix calls fn with a reader of each file under prefix, running up to concurrency calls
+// at once. Each reader reads the generation listed, and is closed once fn returns. Opening a
+// reader is retried on transient errors, reading from it isn't. A failed call doesn't stop the
+// others, the returned error lists every file that failed. Cancelling ctx stops the listing and
+// the reads.
+func ProcessPrefix(ctx context.Context, bucketName, prefix string, concurrency int,
+	fn func(attrs *storage.ObjectAttrs, r io.Reader) error, opts ...BatchOption) error {
+	ctx = batchContext(ctx, opts)
+	var (
+		mu       sync.Mutex
+		failures []string
+	)
+	err := forEachObjectParallel(ctx, bucketName, prefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		if err := processObject(ctx, bucketName, attrs, fn); err != nil {
+			mu.Lock()
+			failures = append(failures, fmt.Sprintf("%s: %v", attrs.Name, err))
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err == nil {
+		// Calls cut short by cancellation aren't failures of their own.
+		err = ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("failed processing %d files: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// processObject calls fn with a reader of the listed generation of attrs
+func processObject(ctx context.Context, bucketName string, attrs *storage.ObjectAttrs,
+	fn func(attrs *storage.ObjectAttrs, r io.Reader) error) error {
+	handle := createStorageObject(bucketName, attrs.Name).Generation(attrs.Generation)
+	var r *storage.Reader
+	err := withRetry(ctx, bucketName, func() error {
+		var err error
+		r, err = handle.NewReader(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(attrs, limitByBudget(ctx, r))
+}
+
+// ReadMany reads the files at paths, running up to concurrency reads at once, and returns their
+// contents by path. Reads are retried on transient errors. A failed read doesn't stop the
+// others, the returned error lists every file that failed, and the contents read are returned
+// along. Cancelling ctx stops the reads.
+func ReadMany(ctx context.Context, bucketName string, paths []string, concurrency int, opts ...BatchOption) (map[string][]byte, error) {
+	ctx = batchContext(ctx, opts)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		contents = make(map[string][]byte, len(paths))
+		failures []string
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, p := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(p string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var data []byte
+			err := withRetry(ctx, bucketName, func() error {
+				var err error
+				data, err = Read(ctx, bucketName, p)
+				return err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", p, err))
+				return
+			}
+			contents[p] = data
+		}(p)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return contents, err
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return contents, fmt.Errorf("failed reading %d files: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return contents, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// pipeline.go defines functions reading gcs files through chains of stream transforms
+
+package gcs
+
+import (
+	"context"
+	"io"
+)
+
+// ReadPipeline opens the specified file and passes its reader through each stage in order, every
+// stage wrapping the reader returned by the previous one, e.g. a decompressor then a filter.
+// Reading the returned reader pulls the content through the whole chain as it's consumed.
+// Important: caller must call Close on the returned reader when done reading, it closes the
+// stages implementing io.Closer, last stage first, then the file reader.
+func ReadPipeline(ctx context.Context, bucketName, filePath string, stages ...func(io.Reader) (io.Reader, error)) (io.ReadCloser, error) {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	p := &pipelineReader{closers: []io.Closer{f}}
+	r := limitByBudget(ctx, f)
+	for _, stage := range stages {
+		if r, err = stage(r); err != nil {
+			p.Close()
+			return nil, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			p.closers = append(p.closers, c)
+		}
+	}
+	p.Reader = r
+	return p, nil
+}
+
+// pipelineReader reads the last stage of a pipeline and closes all of them
+type pipelineReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes all stages, returning the first error
+func (p *pipelineReader) Close() error {
+	var firstErr error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if err := p.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
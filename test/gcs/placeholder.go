@@ -0,0 +1,60 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// placeholder.go defines functions reserving gcs objects of a known size
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// MaxPlaceholderSize is the largest object CreatePlaceholder agrees to write
+const MaxPlaceholderSize = 1 << 30 // 1GiB
+
+// CreatePlaceholder writes a zero-filled object of given size to filePath.
+// GCS has no sparse objects, so all size bytes are uploaded, they are streamed
+// rather than buffered. Sizes above MaxPlaceholderSize are rejected.
+func CreatePlaceholder(ctx context.Context, bucketName, filePath string, size int64) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	if size < 0 || size > MaxPlaceholderSize {
+		return fmt.Errorf("placeholder size %d is out of range [0, %d]", size, MaxPlaceholderSize)
+	}
+	dst := newProfiledWriter(ctx, handle)
+	dst.ContentType = "application/octet-stream"
+	if _, err := io.CopyN(dst, zeroReader{}, size); err != nil {
+		dst.CloseWithError(err)
+		return err
+	}
+	return dst.Close()
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
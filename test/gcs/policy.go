@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// policy.go defines the policies enforced on gcs writes
+
+package gcs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxObjectNameBytes is the maximum length of gcs object names, in UTF-8 bytes
+const maxObjectNameBytes = 1024
+
+// ErrTooLarge is returned by uploads of more bytes than set with SetMaxUploadBytes
+var ErrTooLarge = errors.New("gcs: upload exceeds the maximum size")
+
+// KeyPolicy validates a gcs path before it's written to, returning an error if it's not allowed
+type KeyPolicy func(key string) error
+
+var keyPolicy KeyPolicy
+
+// SetKeyPolicy makes all functions writing files, such as Upload, NewWriter, UploadReader or Copy,
+// reject destination paths for which policy returns an error, before anything is written.
+// This covers files rewritten in place, e.g. by CompressInPlace, and the auxiliary files some
+// functions write, such as upload progress, heartbeat, lock and temporary files.
+// Paths are checked with ValidateKey first, whatever the policy.
+// A nil policy, the default, allows every path.
+// Like Authenticate, it should be called before any other function.
+func SetKeyPolicy(policy KeyPolicy) {
+	keyPolicy = policy
+}
+
+// checkKeyPolicy returns the error of ValidateKey or of the key policy for key, if any
+func checkKeyPolicy(key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	if keyPolicy == nil {
+		return nil
+	}
+	return keyPolicy(key)
+}
+
+// createDestinationObject is createStorageObject for a file about to be written, failing with the
+// error of checkKeyPolicy if filePath isn't allowed. All writes get their handle from it, so the
+// key policy can't be bypassed by any of them.
+func createDestinationObject(bucketName, filePath string) (*storage.ObjectHandle, error) {
+	if err := checkKeyPolicy(filePath); err != nil {
+		return nil, err
+	}
+	return createStorageObject(bucketName, filePath), nil
+}
+
+// ValidateKey checks that gcs accepts key as a file path, once the key prefix and hashing are
+// applied, so invalid paths fail upfront with a clear error rather than when written: the object
+// name must be valid UTF-8 of 1 to 1024 bytes, without carriage return, line feed or other
+// control characters, not "." or "..", and not under ".well-known/acme-challenge/".
+// All functions writing files call it on each path they write, as part of the key policy check,
+// before writing anything. It's exported for callers to validate paths earlier.
+func ValidateKey(key string) error {
+	name := objectName(key)
+	switch {
+	case key == "":
+		return errors.New("invalid gcs path: empty")
+	case !utf8.ValidString(name):
+		return fmt.Errorf("invalid gcs path %q: not valid UTF-8", key)
+	case len(name) > maxObjectNameBytes:
+		return fmt.Errorf("invalid gcs path %q: object name is %d bytes, longer than %d", key, len(name), maxObjectNameBytes)
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid gcs path %q: object name can't be %q", key, name)
+	case strings.HasPrefix(name, ".well-known/acme-challenge/"):
+		return fmt.Errorf("invalid gcs path %q: object names can't start with .well-known/acme-challenge/", key)
+	}
+	for i, r := range name {
+		if r < 0x20 || (r >= 0x7f && r <= 0x9f) {
+			return fmt.Errorf("invalid gcs path %q: control character %U at byte %d of the object name", key, r, i)
+		}
+	}
+	return nil
+}
+
+var maxUploadBytes int64
+
+// SetMaxUploadBytes makes uploads of more than n bytes fail with ErrTooLarge, without creating or
+// replacing the file. It applies to Upload, UploadReader, UploadFromURL, UploadMultipart and
+// UploadWithHashes. Streams of unknown size are aborted as soon as they cross n bytes.
+// A n of 0 or less, the default, means no limit.
+// Like Authenticate, it should be called before any other function.
+func SetMaxUploadBytes(n int64) {
+	maxUploadBytes = n
+}
+
+// capUpload wraps r so that reading more than the maximum upload size fails with ErrTooLarge
+func capUpload(r io.Reader) io.Reader {
+	if maxUploadBytes <= 0 {
+		return r
+	}
+	return &cappedReader{r: r, remaining: maxUploadBytes}
+}
+
+// cappedReader is a Reader failing once more than its remaining bytes were read
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (cr *cappedReader) Read(p []byte) (int, error) {
+	// Reading one byte past the cap tells a stream ending right at the cap from a larger one.
+	if int64(len(p)) > cr.remaining+1 {
+		p = p[:cr.remaining+1]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{"dir/file.txt", false},
+		{"日本語/ファイル", false},
+		{".well-known/other", false},
+		{strings.Repeat("a", maxObjectNameBytes), false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{strings.Repeat("a", maxObjectNameBytes+1), true},
+		// Multi-byte characters count in bytes, not runes.
+		{strings.Repeat("é", maxObjectNameBytes/2+1), true},
+		{"bad\xffutf8", true},
+		{"line\nfeed", true},
+		{"carriage\rreturn", true},
+		{"tab\t", true},
+		{"del\x7f", true},
+		{"c1\u0085", true},
+		{".well-known/acme-challenge/token", true},
+	}
+	for _, test := range tests {
+		if err := ValidateKey(test.key); (err != nil) != test.wantErr {
+			t.Errorf("ValidateKey(%q) = %v, want error %v", test.key, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateKeyPrefix(t *testing.T) {
+	SetKeyPrefix(strings.Repeat("p", maxObjectNameBytes))
+	defer SetKeyPrefix("")
+	if err := ValidateKey("a"); err == nil {
+		t.Error("ValidateKey() = nil, want an error for a name longer than the limit once prefixed")
+	}
+}
+
+func TestKeyPolicyEnforced(t *testing.T) {
+	errDenied := errors.New("denied")
+	SetKeyPolicy(func(key string) error { return errDenied })
+	defer SetKeyPolicy(nil)
+
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		write func() error
+	}{{
+		name:  "KVSet",
+		write: func() error { return KVSet(ctx, "bucket", "kv.json", "k", "v") },
+	}, {
+		name:  "KVDelete",
+		write: func() error { return KVDelete(ctx, "bucket", "kv.json", "k") },
+	}, {
+		name: "IncrementCounter",
+		write: func() error {
+			_, err := IncrementCounter(ctx, "bucket", "counter", 1)
+			return err
+		},
+	}, {
+		name:  "GenerateIndexHTML",
+		write: func() error { return GenerateIndexHTML(ctx, "bucket", "dir") },
+	}, {
+		name: "WriteManifest",
+		write: func() error {
+			_, err := WriteManifest(ctx, "bucket", "dir", time.Now())
+			return err
+		},
+	}, {
+		name: "AcquireLock",
+		write: func() error {
+			_, err := AcquireLock(ctx, "bucket", "lock", time.Minute)
+			return err
+		},
+	}, {
+		name: "UploadReader",
+		write: func() error {
+			return UploadReader(ctx, "bucket", "file", strings.NewReader("content"), WithProgressObject(time.Second))
+		},
+	}, {
+		name: "Benchmark",
+		write: func() error {
+			_, _, err := Benchmark(ctx, "bucket", 1)
+			return err
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, listing())
+			defer f.Close()
+
+			if err := test.write(); err != errDenied {
+				t.Errorf("%s() = %v, want %v", test.name, err, errDenied)
+			}
+			for _, r := range f.requests() {
+				if strings.HasPrefix(r, "POST ") || strings.HasPrefix(r, "PUT ") || strings.HasPrefix(r, "PATCH ") {
+					t.Errorf("Got write request %q, want none", r)
+				}
+			}
+		})
+	}
+
+	f := newFakeGCS(t, listing())
+	defer f.Close()
+	StartHeartbeat(ctx, "bucket", "dir", time.Second)()
+	if got := f.requests(); len(got) != 0 {
+		t.Errorf("StartHeartbeat() sent requests %v, want none", got)
+	}
+}
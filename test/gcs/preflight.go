@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// preflight.go defines functions checking required gcs files are present
+
+package gcs
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// existenceConcurrency is the number of existence checks FirstMissing and ExistenceBitmap run at once
+const existenceConcurrency = 16
+
+// FirstMissing checks concurrently that all paths exist and returns the first path found missing,
+// or "" if they all exist. As checks run concurrently, it's not necessarily the first missing
+// path of the list. Checks still running are cancelled once a path is found missing or a check
+// fails with another error, which is then returned.
+func FirstMissing(ctx context.Context, bucketName string, paths []string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		missing  string
+		firstErr error
+	)
+	sem := make(chan struct{}, existenceConcurrency)
+	for _, p := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(p string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, err := createStorageObject(bucketName, p).Attrs(ctx)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if missing != "" || firstErr != nil {
+				return
+			}
+			if err == storage.ErrObjectNotExist {
+				missing = p
+			} else {
+				firstErr = err
+			}
+			cancel()
+		}(p)
+	}
+	wg.Wait()
+	if missing != "" {
+		return missing, nil
+	}
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return "", ctx.Err()
+}
+
+// ExistenceBitmap checks concurrently whether each of paths exists, and returns the results in the
+// order of paths. Errors other than a path not existing fail the whole check, cancelling the
+// checks still running, rather than being reported as missing.
+func ExistenceBitmap(ctx context.Context, bucketName string, paths []string) ([]bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	exists := make([]bool, len(paths))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, existenceConcurrency)
+	for i, p := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, p string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// Each goroutine writes its own element, so exists needs no lock.
+			_, err := createStorageObject(bucketName, p).Attrs(ctx)
+			switch err {
+			case nil:
+				exists[i] = true
+			case storage.ErrObjectNotExist:
+			default:
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// profile.go defines per-bucket settings of gcs operations
+
+package gcs
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// BucketProfile holds the settings of operations on a bucket, see SetBucketProfile.
+// Zero fields fall back to the package-wide settings.
+type BucketProfile struct {
+	// Timeout bounds each single file operation, retries included: calls such as Copy, Download,
+	// Upload, Read or CompressInPlace, and each file written by multi-file calls such as UploadDir
+	// or UploadSharded. 0 means no timeout other than the context's.
+	Timeout time.Duration
+	// Retry is the retry policy, replacing the one set with SetRetryPolicy
+	Retry RetryPolicy
+	// ChunkSize is the buffer size of all uploads, see storage.Writer.
+	// 0 means the storage library default.
+	ChunkSize int
+}
+
+var bucketProfiles = make(map[string]BucketProfile)
+
+// SetBucketProfile sets the settings applied to operations on bucketName, e.g. longer timeouts and
+// more retries for a slow multi-region bucket. Buckets without a profile use the package-wide
+// settings. Copies use the profile of their destination bucket.
+// Like Authenticate, it should be called before any other function.
+func SetBucketProfile(bucketName string, profile BucketProfile) {
+	bucketProfiles[bucketName] = profile
+}
+
+// profileFor returns the profile of bucketName, with the package-wide settings filled in
+func profileFor(bucketName string) BucketProfile {
+	p := bucketProfiles[bucketName]
+	if p.Retry == (RetryPolicy{}) {
+		p.Retry = retryPolicy
+	}
+	return p
+}
+
+// withBucketTimeout derives a context bounded by the timeout of bucketName's profile, if any
+func withBucketTimeout(ctx context.Context, bucketName string) (context.Context, context.CancelFunc) {
+	if timeout := profileFor(bucketName).Timeout; timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// newProfiledWriter creates a writer of handle using the chunk size of its bucket's profile
+func newProfiledWriter(ctx context.Context, handle *storage.ObjectHandle) *storage.Writer {
+	w := handle.NewWriter(ctx)
+	if size := profileFor(handle.BucketName()).ChunkSize; size > 0 {
+		w.ChunkSize = size
+	}
+	return w
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// provenance.go defines the optional provenance metadata stamped on uploaded gcs files
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Metadata keys of the provenance stamped by Upload once EnableProvenance is called
+const (
+	UploadedByMetadata = "uploaded-by"
+	UploadTimeMetadata = "upload-time"
+	SourceHostMetadata = "source-host"
+)
+
+// ErrNoProvenance is returned by Provenance for files uploaded without provenance
+var ErrNoProvenance = errors.New("gcs: file has no provenance metadata")
+
+// UploadProvenance tells who uploaded a file, when, and from where
+type UploadProvenance struct {
+	UploadedBy string
+	UploadTime time.Time
+	SourceHost string
+}
+
+var (
+	provenanceEnabled bool
+	provenanceUser    string
+)
+
+// EnableProvenance makes Upload stamp the metadata of each file with uploadedBy, e.g. a job or
+// service account name, the upload time and the local host name, which Provenance reads back.
+// Like Authenticate, it should be called before any other function.
+func EnableProvenance(uploadedBy string) {
+	provenanceEnabled = true
+	provenanceUser = uploadedBy
+}
+
+// stampProvenance adds the provenance metadata to attrs, if enabled
+func stampProvenance(attrs *storage.ObjectAttrs) {
+	if !provenanceEnabled {
+		return
+	}
+	if attrs.Metadata == nil {
+		attrs.Metadata = make(map[string]string)
+	}
+	host, _ := os.Hostname()
+	attrs.Metadata[UploadedByMetadata] = provenanceUser
+	attrs.Metadata[UploadTimeMetadata] = time.Now().UTC().Format(time.RFC3339)
+	attrs.Metadata[SourceHostMetadata] = host
+}
+
+// Provenance returns the provenance stamped on the file when it was uploaded,
+// or ErrNoProvenance if there's none
+func Provenance(ctx context.Context, bucketName, filePath string) (*UploadProvenance, error) {
+	attrs, err := createStorageObject(bucketName, filePath).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rawTime, ok := attrs.Metadata[UploadTimeMetadata]
+	if !ok {
+		return nil, ErrNoProvenance
+	}
+	uploadTime, err := time.Parse(time.RFC3339, rawTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload time %q of %q: %v", rawTime, filePath, err)
+	}
+	return &UploadProvenance{
+		UploadedBy: attrs.Metadata[UploadedByMetadata],
+		UploadTime: uploadTime,
+		SourceHost: attrs.Metadata[SourceHostMetadata],
+	}, nil
+}
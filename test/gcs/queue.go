@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// queue.go defines a bounded queue of uploads to gcs
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// UploadQueue uploads enqueued files to a bucket with a fixed number of workers. Its queue is
+// bounded, Enqueue blocks while it's full, so producers are slowed down to the pace gcs accepts
+// files at instead of piling them up in memory. Enqueue is safe for concurrent use.
+type UploadQueue struct {
+	ctx        context.Context
+	bucketName string
+	items      chan uploadItem
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	failures   []string
+}
+
+// uploadItem is a file waiting in an UploadQueue
+type uploadItem struct {
+	path string
+	data []byte
+}
+
+// NewUploadQueue creates an UploadQueue uploading to bucketName with workers concurrent uploads,
+// holding up to capacity files waiting for a worker.
+func NewUploadQueue(ctx context.Context, bucketName string, workers, capacity int) *UploadQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	q := &UploadQueue{ctx: ctx, bucketName: bucketName, items: make(chan uploadItem, capacity)}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue adds the file to upload, blocking while the queue is full.
+// It must not be called once Wait was called.
+func (q *UploadQueue) Enqueue(path string, data []byte) {
+	q.items <- uploadItem{path: path, data: data}
+}
+
+// Wait waits for all enqueued files to be uploaded and stops the workers. Failed uploads don't
+// stop the others, the returned error lists every file that failed.
+func (q *UploadQueue) Wait() error {
+	close(q.items)
+	q.wg.Wait()
+	if len(q.failures) == 0 {
+		return nil
+	}
+	sort.Strings(q.failures)
+	return fmt.Errorf("failed uploading %d files: %s", len(q.failures), strings.Join(q.failures, "; "))
+}
+
+// work uploads files until the queue is closed
+func (q *UploadQueue) work() {
+	defer q.wg.Done()
+	for item := range q.items {
+		if err := q.upload(item); err != nil {
+			q.mu.Lock()
+			q.failures = append(q.failures, fmt.Sprintf("%s: %v", item.path, err))
+			q.mu.Unlock()
+		}
+	}
+}
+
+// upload uploads a single file
+func (q *UploadQueue) upload(item uploadItem) error {
+	handle, err := createDestinationObject(q.bucketName, item.path)
+	if err != nil {
+		return err
+	}
+	attrs := &storage.ObjectAttrs{ContentType: inferContentType(item.path)}
+	_, err = writeObject(q.ctx, handle, item.data, attrs)
+	return err
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// ratelimit.go defines the optional rate limit of gcs listing requests
+
+package gcs
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/api/iterator"
+)
+
+// listLimiter limits the rate of listing requests, nil means unlimited
+var listLimiter *rate.Limiter
+
+// SetListRateLimit caps the listing page fetches of all functions of this package to
+// requestsPerSecond, to keep heavy scanners under the project's read quota.
+// A value of 0 or less removes the limit, which is the default.
+// Like Authenticate, it should be called before any other function.
+func SetListRateLimit(requestsPerSecond float64) {
+	if requestsPerSecond <= 0 {
+		listLimiter = nil
+		return
+	}
+	listLimiter = rate.NewLimiter(rate.Limit(requestsPerSecond), 1)
+}
+
+// waitForListPage blocks until the listing quota allows another request, if the next call to the
+// iterator owning pageInfo is going to fetch a page. started tells if a page was already fetched.
+func waitForListPage(ctx context.Context, pageInfo *iterator.PageInfo, started bool) error {
+	if listLimiter == nil || pageInfo.Remaining() > 0 || (started && pageInfo.Token == "") {
+		return nil
+	}
+	return listLimiter.Wait(ctx)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// redirect.go defines functions following pointer files, the gcs equivalent of symlinks
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+)
+
+// RedirectMetadata is the metadata key marking a file as a pointer, its value is the path
+// of the target file in the same bucket
+const RedirectMetadata = "redirect"
+
+// ReadFollow reads the specified file, following pointer files marked with RedirectMetadata
+// to their target, for up to maxHops pointers. It returns the content of the first file which
+// isn't a pointer, along with its path. Pointers leading back to a file already visited are an
+// error, as are chains longer than maxHops.
+func ReadFollow(ctx context.Context, bucketName, filePath string, maxHops int) ([]byte, string, error) {
+	origin := filePath
+	visited := map[string]bool{}
+	for hops := 0; ; hops++ {
+		visited[filePath] = true
+		handle := createStorageObject(bucketName, filePath)
+		attrs, err := handle.Attrs(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		target, ok := attrs.Metadata[RedirectMetadata]
+		if !ok {
+			contents, err := readGeneration(ctx, handle, attrs.Generation)
+			return contents, filePath, err
+		}
+		if hops == maxHops {
+			return nil, "", fmt.Errorf("too many redirects following %q, gave up at %q", origin, target)
+		}
+		if visited[target] {
+			return nil, "", fmt.Errorf("redirect loop: %q points back to %q", filePath, target)
+		}
+		filePath = target
+	}
+}
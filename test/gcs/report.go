@@ -0,0 +1,209 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// report.go defines functions summarizing storage usage under a gcs path
+
+package gcs
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// UndatedGroup is the GroupByDatePrefix group of files without a date at the expected depth
+const UndatedGroup = "undated"
+
+// UnclassifiedGroup is the ClassifyPrefix group of files matching no rule
+const UnclassifiedGroup = "unclassified"
+
+// dateLayouts are the date formats recognized in path segments
+var dateLayouts = []string{"2006-01-02", "20060102"}
+
+// GroupByDatePrefix sums the sizes of all files under prefix, grouped by the path segment at
+// dateDepth, counting segments from 0 right after prefix. For example with prefix "logs/",
+// "logs/2019-01-15/build.txt" is grouped under "2019-01-15" for a dateDepth of 0.
+// Dates are returned as YYYY-MM-DD, files without a date at that depth are grouped under UndatedGroup.
+func GroupByDatePrefix(ctx context.Context, bucketName, prefix string, dateDepth int) (map[string]int64, error) {
+	groups := make(map[string]int64)
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		group := UndatedGroup
+		segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(attrs.Name, prefix), "/"), "/")
+		// The last segment is the file name, not a directory.
+		if dateDepth >= 0 && dateDepth < len(segments)-1 {
+			if date, ok := parseDate(segments[dateDepth]); ok {
+				group = date.Format(dateLayouts[0])
+			}
+		}
+		groups[group] += attrs.Size
+		return nil
+	})
+	return groups, err
+}
+
+// parseDate parses s with any of dateLayouts
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sizeHeap is a min-heap of files by size
+type sizeHeap []*storage.ObjectAttrs
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(*storage.ObjectAttrs)) }
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// LargestObjects returns the topN largest files under prefix, largest first.
+// Only topN files are kept in memory while listing.
+func LargestObjects(ctx context.Context, bucketName, prefix string, topN int) ([]*storage.ObjectAttrs, error) {
+	if topN <= 0 {
+		return nil, nil
+	}
+	h := make(sizeHeap, 0, topN)
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if h.Len() < topN {
+			heap.Push(&h, attrs)
+		} else if attrs.Size > h[0].Size {
+			h[0] = attrs
+			heap.Fix(&h, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(h, func(i, j int) bool { return h[i].Size > h[j].Size })
+	return h, nil
+}
+
+// PricingTable maps storage classes, e.g. "STANDARD" or "COLDLINE", to their monthly price per GB.
+// Prices vary by region and change over time, so they are left to the caller.
+type PricingTable map[string]float64
+
+// EstimateMonthlyCost sums the sizes of files under prefix by storage class and returns
+// the monthly storage cost according to pricing, where a GB is 2^30 bytes as gcs bills.
+// Operation and network costs aren't included. A storage class missing from pricing is an error.
+func EstimateMonthlyCost(ctx context.Context, bucketName, prefix string, pricing PricingTable) (float64, error) {
+	bytesByClass := make(map[string]int64)
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		bytesByClass[attrs.StorageClass] += attrs.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var cost float64
+	for class, size := range bytesByClass {
+		price, ok := pricing[class]
+		if !ok {
+			return 0, fmt.Errorf("no price for storage class %q", class)
+		}
+		cost += float64(size) / (1 << 30) * price
+	}
+	return cost, nil
+}
+
+// AnomalousObjects returns the files under prefix smaller than minBytes or larger than maxBytes,
+// e.g. truncated empty logs or runaway outputs. A maxBytes of 0 or less means no upper bound.
+// Directory placeholders, names ending with "/", are ignored.
+func AnomalousObjects(ctx context.Context, bucketName, prefix string, minBytes, maxBytes int64) ([]*storage.ObjectAttrs, error) {
+	var anomalous []*storage.ObjectAttrs
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if strings.HasSuffix(attrs.Name, "/") {
+			return nil
+		}
+		if attrs.Size < minBytes || (maxBytes > 0 && attrs.Size > maxBytes) {
+			anomalous = append(anomalous, attrs)
+		}
+		return nil
+	})
+	return anomalous, err
+}
+
+// SizeHistogram counts the files under prefix by size, into buckets given by their inclusive
+// upper bounds: each file is counted under the smallest bound at least its size, and files larger
+// than all bounds under math.MaxInt64. All bounds are in the result, with 0 for empty buckets.
+// Listing stops with ctx's error once ctx is done.
+func SizeHistogram(ctx context.Context, bucketName, prefix string, buckets []int64) (map[int64]int, error) {
+	bounds := append([]int64(nil), buckets...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	histogram := make(map[int64]int, len(bounds)+1)
+	for _, b := range bounds {
+		histogram[b] = 0
+	}
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		i := sort.Search(len(bounds), func(i int) bool { return bounds[i] >= attrs.Size })
+		if i == len(bounds) {
+			histogram[math.MaxInt64]++
+		} else {
+			histogram[bounds[i]]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return histogram, nil
+}
+
+// ClassifyPrefix groups the paths of the files under prefix by the name of the first of rules
+// matching them, e.g. "junit" for `junit.*\.xml$`, and UnclassifiedGroup for those matching none.
+// Maps have no order, so rules are tried in the lexicographic order of their names.
+func ClassifyPrefix(ctx context.Context, bucketName, prefix string, rules map[string]*regexp.Regexp) (map[string][]string, error) {
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make(map[string][]string)
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		group := UnclassifiedGroup
+		for _, name := range names {
+			if rules[name].MatchString(attrs.Name) {
+				group = name
+				break
+			}
+		}
+		groups[group] = append(groups[group], attrs.Name)
+		return nil
+	})
+	return groups, err
+}
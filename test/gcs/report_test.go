@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// putSizes stores a file of each size, named after its index
+func putSizes(m *memGCS, sizes ...int) {
+	for i, size := range sizes {
+		m.put(fmt.Sprintf("file-%d", i), make([]byte, size))
+	}
+}
+
+func TestLargestObjects(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+		topN  int
+		want  []int64
+	}{
+		{"no files", nil, 3, nil},
+		{"no top", []int{1, 2}, 0, nil},
+		{"fewer files than top", []int{5, 1, 3}, 5, []int64{5, 3, 1}},
+		{"exactly top", []int{5, 1, 3}, 3, []int64{5, 3, 1}},
+		{"more files than top", []int{4, 9, 1, 7, 3, 8, 2}, 3, []int64{9, 8, 7}},
+		{"top one", []int{4, 9, 1}, 1, []int64{9}},
+		{"ties", []int{2, 2, 1, 2}, 2, []int64{2, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			putSizes(m, test.sizes...)
+
+			top, err := LargestObjects(context.Background(), "bucket", "", test.topN)
+			if err != nil {
+				t.Fatalf("LargestObjects() = %v", err)
+			}
+			var got []int64
+			for _, attrs := range top {
+				got = append(got, attrs.Size)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("LargestObjects() sizes = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizes   []int
+		buckets []int64
+		want    map[int64]int
+	}{
+		{"no files", nil, []int64{10}, map[int64]int{10: 0}},
+		{"no buckets", []int{1, 2}, nil, map[int64]int{math.MaxInt64: 2}},
+		// Bounds are inclusive, and may be given in any order.
+		{"bounds", []int{0, 10, 11, 100, 101}, []int64{100, 10}, map[int64]int{10: 2, 100: 2, math.MaxInt64: 1}},
+		{"empty bucket", []int{50}, []int64{10, 100, 1000}, map[int64]int{10: 0, 100: 1, 1000: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemGCS(t)
+			defer m.Close()
+			putSizes(m, test.sizes...)
+
+			got, err := SizeHistogram(context.Background(), "bucket", "", test.buckets)
+			if err != nil {
+				t.Fatalf("SizeHistogram() = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SizeHistogram() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// retry.go defines the policy retrying gcs operations failing transiently
+
+package gcs
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy configures how operations failing transiently are retried, with exponential backoff
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry, doubled on each retry
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used unless SetRetryPolicy is called
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// SetRetryPolicy sets the policy retrying operations failing transiently, such as Copy and the
+// other server-side copies and rewrites, on buckets without a profile setting one,
+// see SetBucketProfile.
+// Like Authenticate, it should be called before any other function.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// isRetryable checks if err is transient: rate limiting, a server error, or a network failure
+func isRetryable(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// withRetry calls fn until it succeeds, fails with an error that's not retryable, the attempts
+// of the retry policy of bucketName are exhausted, or the retry budget of ctx, if any, is spent,
+// and returns its last error
+func withRetry(ctx context.Context, bucketName string, fn func() error) error {
+	policy := profileFor(bucketName).Retry
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		if b, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok && !b.take(delay) {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > policy.MaxDelay && policy.MaxDelay > 0 {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// retryBudget is a total time retries of a batch may spend waiting, shared by all its operations
+type retryBudget struct {
+	mu        sync.Mutex
+	remaining time.Duration
+}
+
+// retryBudgetKey is the context key of the retryBudget
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a copy of ctx whose retries share a budget of total waiting time
+func withRetryBudget(ctx context.Context, total time.Duration) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: total})
+}
+
+// take reserves delay from the budget, returning false if there isn't enough left
+func (b *retryBudget) take(delay time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if delay > b.remaining {
+		return false
+	}
+	b.remaining -= delay
+	return true
+}
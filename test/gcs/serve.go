@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// serve.go defines functions serving gcs files over HTTP
+
+package gcs
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ServeObject writes the specified file as the response to r, with its content type and
+// modification time. Files stored with "Content-Encoding: gzip" are sent compressed as stored to
+// clients accepting gzip, and decompressed to the others, with "Vary: Accept-Encoding" either way
+// so caches keep both. Missing files get a 404, other gcs errors a 502.
+func ServeObject(w http.ResponseWriter, r *http.Request, bucketName, filePath string) {
+	ctx := r.Context()
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed reading attrs of %q: %v", filePath, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	handle = handle.Generation(attrs.Generation)
+	header := w.Header()
+	header.Set("Content-Type", attrs.ContentType)
+	header.Set("Last-Modified", attrs.Updated.UTC().Format(http.TimeFormat))
+	if attrs.CacheControl != "" {
+		header.Set("Cache-Control", attrs.CacheControl)
+	}
+	length := attrs.Size
+	if attrs.ContentEncoding == "gzip" {
+		header.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			header.Set("Content-Encoding", "gzip")
+			handle = handle.ReadCompressed(true)
+		} else {
+			// gcs decompresses the content itself, its size isn't known ahead.
+			length = -1
+		}
+	}
+	if length >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	src, err := handle.NewReader(ctx)
+	if err != nil {
+		log.Printf("Failed reading %q: %v", filePath, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer src.Close()
+	if _, err := io.Copy(w, limitByBudget(ctx, src)); err != nil {
+		// Headers are sent already, the client sees a truncated response.
+		log.Printf("Failed serving %q: %v", filePath, err)
+	}
+}
+
+// acceptsGzip checks if the Accept-Encoding header of r allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(field, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// shard.go defines functions splitting streams into several gcs or local files and joining them back
+
+package gcs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// shardPrefix is the name prefix of shard files, followed by their index
+	shardPrefix = "part-"
+	// chunkPrefix is the name prefix of the local chunk files of DownloadChunks, followed by their index
+	chunkPrefix = "chunk-"
+)
+
+// UploadSharded uploads the content of r as consecutive shard files dstPrefix/part-0000,
+// dstPrefix/part-0001, ... of at most maxShardBytes each, and returns the shard paths.
+// An empty stream still makes a single empty shard. Use NewShardedReader to read them back.
+// Shards are written one at a time, if one fails the ones already written are left in place.
+func UploadSharded(ctx context.Context, bucketName, dstPrefix string, r io.Reader, maxShardBytes int64) ([]string, error) {
+	if maxShardBytes < 1 {
+		return nil, fmt.Errorf("invalid shard size %d", maxShardBytes)
+	}
+	br := bufio.NewReader(r)
+	var shards []string
+	for i := 0; ; i++ {
+		if i > 0 {
+			// Only start another shard if there's content left for it.
+			if _, err := br.Peek(1); err == io.EOF {
+				return shards, nil
+			} else if err != nil {
+				return shards, err
+			}
+		}
+		shardPath := path.Join(dstPrefix, fmt.Sprintf("%s%04d", shardPrefix, i))
+		handle, err := createDestinationObject(bucketName, shardPath)
+		if err != nil {
+			return shards, err
+		}
+		n, err := uploadShard(ctx, handle, br, maxShardBytes)
+		if err != nil {
+			return shards, fmt.Errorf("failed uploading shard %q: %v", shardPath, err)
+		}
+		shards = append(shards, shardPath)
+		if n < maxShardBytes {
+			return shards, nil
+		}
+	}
+}
+
+// uploadShard uploads up to maxShardBytes of r to handle, within the timeout of the bucket's
+// profile, and returns the number of bytes uploaded
+func uploadShard(ctx context.Context, handle *storage.ObjectHandle, r io.Reader, maxShardBytes int64) (int64, error) {
+	ctx, cancel := withBucketTimeout(ctx, handle.BucketName())
+	defer cancel()
+	w := newProfiledWriter(ctx, handle)
+	w.ContentType = "application/octet-stream"
+	n, err := io.CopyN(w, r, maxShardBytes)
+	if err != nil && err != io.EOF {
+		w.CloseWithError(err)
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// NewShardedReader creates a reader of the content uploaded by UploadSharded to dstPrefix,
+// streaming its shards one after the other in index order.
+// Important: caller must call Close on the returned reader when done reading
+func NewShardedReader(ctx context.Context, bucketName, dstPrefix string) (io.ReadCloser, error) {
+	prefix := dirPrefix(dstPrefix)
+	type shard struct {
+		index int
+		path  string
+	}
+	var shards []shard
+	err := iterateObjects(ctx, bucketName, prefix+shardPrefix, "/", func(attrs *storage.ObjectAttrs) error {
+		index, err := strconv.Atoi(strings.TrimPrefix(attrs.Name, prefix+shardPrefix))
+		if err == nil {
+			shards = append(shards, shard{index, attrs.Name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, ErrNotFound
+	}
+	// Indexes outgrow their zero padding, so sort them as numbers.
+	sort.Slice(shards, func(i, j int) bool { return shards[i].index < shards[j].index })
+	sr := &shardedReader{ctx: ctx, bucketName: bucketName}
+	for i, s := range shards {
+		if s.index != i {
+			return nil, fmt.Errorf("shard %d is missing under %q", i, dstPrefix)
+		}
+		sr.paths = append(sr.paths, s.path)
+	}
+	return sr, nil
+}
+
+// shardedReader reads shards in order, opening each one once the previous one is read
+type shardedReader struct {
+	ctx        context.Context
+	bucketName string
+	paths      []string
+	current    *storage.Reader
+	// src reads current within the ByteBudget of ctx
+	src io.Reader
+}
+
+func (sr *shardedReader) Read(p []byte) (int, error) {
+	for {
+		if sr.current == nil {
+			if len(sr.paths) == 0 {
+				return 0, io.EOF
+			}
+			r, err := NewReader(sr.ctx, sr.bucketName, sr.paths[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed opening shard %q: %v", sr.paths[0], err)
+			}
+			sr.current, sr.src, sr.paths = r, limitByBudget(sr.ctx, r), sr.paths[1:]
+		}
+		n, err := sr.src.Read(p)
+		if err == io.EOF {
+			sr.current.Close()
+			sr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the shard being read, if any
+func (sr *shardedReader) Close() error {
+	if sr.current == nil {
+		return nil
+	}
+	err := sr.current.Close()
+	sr.current = nil
+	return err
+}
+
+// DownloadChunks streams the file into consecutive local files dstDir/chunk-0000,
+// dstDir/chunk-0001, ... of chunkBytes each, the last one possibly shorter, and returns their
+// paths. An empty file makes no chunk. dstDir is created if needed, and existing chunks replaced.
+// If a chunk fails, the ones already written are left in place.
+func DownloadChunks(ctx context.Context, bucketName, filePath, dstDir string, chunkBytes int64) ([]string, error) {
+	if chunkBytes < 1 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkBytes)
+	}
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(limitByBudget(ctx, f))
+	var chunks []string
+	for i := 0; ; i++ {
+		// Only start another chunk if there's content left for it.
+		if _, err := br.Peek(1); err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return chunks, err
+		}
+		chunkPath := filepath.Join(dstDir, fmt.Sprintf("%s%04d", chunkPrefix, i))
+		if err := writeChunk(chunkPath, br, chunkBytes); err != nil {
+			return chunks, fmt.Errorf("failed writing chunk %q: %v", chunkPath, err)
+		}
+		chunks = append(chunks, chunkPath)
+	}
+}
+
+// writeChunk writes up to n bytes of r to the local file chunkPath
+func writeChunk(chunkPath string, r io.Reader, n int64) error {
+	dst, err := os.Create(chunkPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(dst, r, n); err != nil && err != io.EOF {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
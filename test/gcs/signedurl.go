@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// signedurl.go defines functions signing URLs granting temporary access to gcs files
+
+package gcs
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// ErrNoSigner is returned when signing URLs before SetURLSigner was called
+var ErrNoSigner = errors.New("gcs: no URL signer set, call SetURLSigner first")
+
+// urlSigner holds the service account signing URLs
+var urlSigner struct {
+	accessID   string
+	privateKey []byte
+}
+
+// SetURLSigner sets the service account signing URLs, from its JSON key file. The key is checked
+// to be a usable RSA private key, so signing doesn't fail later on.
+// Like Authenticate, it should be called before any other function.
+func SetURLSigner(serviceAccount string) error {
+	data, err := ioutil.ReadFile(serviceAccount)
+	if err != nil {
+		return err
+	}
+	conf, err := google.JWTConfigFromJSON(data)
+	if err != nil {
+		return fmt.Errorf("invalid service account key %q: %v", serviceAccount, err)
+	}
+	if conf.Email == "" {
+		return fmt.Errorf("invalid service account key %q: missing client email", serviceAccount)
+	}
+	if err := checkSigningKey(conf.PrivateKey); err != nil {
+		return fmt.Errorf("invalid service account key %q: %v", serviceAccount, err)
+	}
+	urlSigner.accessID, urlSigner.privateKey = conf.Email, conf.PrivateKey
+	return nil
+}
+
+// checkSigningKey checks that key is a PEM encoded RSA private key, as URL signing requires
+func checkSigningKey(key []byte) error {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return errors.New("private key isn't PEM encoded")
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("unparsable private key: %v", err)
+	}
+	if _, ok := parsed.(*rsa.PrivateKey); !ok {
+		return fmt.Errorf("private key is a %T, not an RSA key", parsed)
+	}
+	return nil
+}
+
+// SignedURLWithResponseHeaders returns a URL reading the file without credentials until expiry
+// from now, served with the given Content-Type and Content-Disposition headers instead of the
+// stored ones, e.g. "text/plain" to render a log inline or `attachment; filename="build.log"`
+// to download it under a given name. Empty headers aren't overridden.
+func SignedURLWithResponseHeaders(bucketName, filePath string, expiry time.Duration, contentType, disposition string) (string, error) {
+	if urlSigner.accessID == "" {
+		return "", ErrNoSigner
+	}
+	if expiry <= 0 {
+		return "", fmt.Errorf("invalid expiry %v of signed URL of %q: must be positive", expiry, filePath)
+	}
+	signed, err := storage.SignedURL(bucketName, objectName(filePath), &storage.SignedURLOptions{
+		GoogleAccessID: urlSigner.accessID,
+		PrivateKey:     urlSigner.privateKey,
+		Method:         http.MethodGet,
+		Expires:        time.Now().Add(expiry),
+	})
+	if err != nil {
+		return "", err
+	}
+	// V2 signatures don't cover query parameters, so response overrides can be added after signing.
+	u, err := url.Parse(signed)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if contentType != "" {
+		q.Set("response-content-type", contentType)
+	}
+	if disposition != "" {
+		q.Set("response-content-disposition", disposition)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// SignedSpec is a file to sign a URL of with SignedURLsWithHeaders, and its response overrides
+type SignedSpec struct {
+	// Path is the path of the file
+	Path string
+	// ContentType overrides the Content-Type header served, if not empty
+	ContentType string
+	// Disposition overrides the Content-Disposition header served, if not empty
+	Disposition string
+}
+
+// SignedURLsWithHeaders is SignedURLWithResponseHeaders for each of specs, returning the URLs
+// by file path. A failed signing doesn't stop the others, the returned error lists every file
+// that failed, and the URLs signed are returned along.
+func SignedURLsWithHeaders(bucketName string, specs []SignedSpec, expiry time.Duration) (map[string]string, error) {
+	if urlSigner.accessID == "" {
+		return nil, ErrNoSigner
+	}
+	urls := make(map[string]string, len(specs))
+	var failures []string
+	for _, spec := range specs {
+		u, err := SignedURLWithResponseHeaders(bucketName, spec.Path, expiry, spec.ContentType, spec.Disposition)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", spec.Path, err))
+			continue
+		}
+		urls[spec.Path] = u
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return urls, fmt.Errorf("failed signing URLs of %d files: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return urls, nil
+}
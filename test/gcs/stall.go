@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// stall.go defines the detection of gcs reads making no progress
+
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled is returned by reads receiving no byte for the stall timeout of their context
+var ErrStalled = errors.New("gcs: read stalled")
+
+// stallKey is the context key of the stall timeout
+type stallKey struct{}
+
+// WithStallTimeout returns a copy of ctx carrying timeout, so that Read, ReadWithAttrs, Download,
+// DownloadTemp and ScanLines calls made with it are aborted with ErrStalled once no byte arrives
+// for timeout, e.g. on a half-open connection, however far away ctx's deadline is.
+func WithStallTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, stallKey{}, timeout)
+}
+
+// stallWatch cancels the context of a read once it makes no progress for its timeout.
+// A nil stallWatch watches nothing.
+type stallWatch struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+// watchStalls derives the context to open a read with from ctx, canceled once the read
+// stalls for the stall timeout of ctx, if any. stop must be called once the read is done.
+func watchStalls(ctx context.Context) (context.Context, *stallWatch, func()) {
+	timeout, ok := ctx.Value(stallKey{}).(time.Duration)
+	if !ok || timeout <= 0 {
+		return ctx, nil, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &stallWatch{timeout: timeout}
+	// Opening the read counts too, a request hanging before any byte arrives is a stall.
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		cancel()
+	})
+	return ctx, w, func() {
+		w.timer.Stop()
+		cancel()
+	}
+}
+
+// wrap returns a reader of r timing each of its reads, time spent outside them by a slow
+// consumer doesn't count as a stall
+func (w *stallWatch) wrap(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &stallReader{r: r, watch: w}
+}
+
+// err returns ErrStalled in place of err if the read was aborted for stalling
+func (w *stallWatch) err(err error) error {
+	if err != nil && w != nil && atomic.LoadInt32(&w.stalled) == 1 {
+		return ErrStalled
+	}
+	return err
+}
+
+// stallReader is a Reader of a watched read
+type stallReader struct {
+	r     io.Reader
+	watch *stallWatch
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	sr.watch.timer.Reset(sr.watch.timeout)
+	n, err := sr.r.Read(p)
+	sr.watch.timer.Stop()
+	return n, sr.watch.err(err)
+}
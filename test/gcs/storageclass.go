@@ -0,0 +1,61 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// storageclass.go defines functions moving gcs files between storage classes
+
+package gcs
+
+import (
+	"context"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+)
+
+// SetStorageClassPrefix rewrites all files under prefix to storageClass (e.g. "COLDLINE"),
+// running up to concurrency rewrites at once. Files already in storageClass are skipped, and so
+// are files replaced since they were listed, rather than reverted to their listed content.
+// It returns the number of files changed.
+func SetStorageClassPrefix(ctx context.Context, bucketName, prefix, storageClass string, concurrency int) (int, error) {
+	var changed int64
+	err := forEachObjectParallel(ctx, bucketName, prefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		if attrs.StorageClass == storageClass {
+			return nil
+		}
+		handle, err := createDestinationObject(bucketName, attrs.Name)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := withBucketTimeout(ctx, bucketName)
+		defer cancel()
+		copier := handle.If(storage.Conditions{GenerationMatch: attrs.Generation}).CopierFrom(handle.Generation(attrs.Generation))
+		keepEditableAttrs(&copier.ObjectAttrs, attrs)
+		copier.StorageClass = storageClass
+		err = withRetry(ctx, bucketName, func() error {
+			_, err := copier.Run(ctx)
+			return err
+		})
+		if isPreconditionFailed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&changed, 1)
+		return nil
+	})
+	return int(changed), err
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// rewriteServer answers listings with files at generation 1 and rewrites with status,
+// failing the test if a rewrite isn't conditioned on the listed generation
+func rewriteServer(t *testing.T, status int, names ...string) http.HandlerFunc {
+	list := listing(names...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/rewriteTo/") {
+			list(w, r)
+			return
+		}
+		if got := r.URL.Query().Get("ifGenerationMatch"); got != "1" {
+			t.Errorf("Rewrite of %q has ifGenerationMatch %q, want 1", r.URL.Path, got)
+		}
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			fmt.Fprintf(w, `{"error": {"code": %d, "message": "%s"}}`, status, http.StatusText(status))
+			return
+		}
+		fmt.Fprint(w, `{"done": true, "resource": {"bucket": "bucket", "name": "rewritten", "generation": "2"}}`)
+	}
+}
+
+func TestSetStorageClassPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"rewritten", http.StatusOK, 2},
+		// Files replaced since the listing are skipped instead of reverted.
+		{"replaced", http.StatusPreconditionFailed, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, rewriteServer(t, test.status, "dir/a", "dir/b"))
+			defer f.Close()
+
+			got, err := SetStorageClassPrefix(context.Background(), "bucket", "dir/", "COLDLINE", 2)
+			if err != nil {
+				t.Fatalf("SetStorageClassPrefix() = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SetStorageClassPrefix() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// sync.go defines functions uploading local directories to gcs, downloading gcs paths to local
+// directories and comparing the two
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// ChecksumsFile is the name of the checksum manifest written by UploadDir with WithChecksumManifest
+const ChecksumsFile = "CHECKSUMS.txt"
+
+// UploadDirOption configures UploadDir
+type UploadDirOption func(*uploadDirOptions)
+
+// uploadDirOptions holds the settings of a single UploadDir call
+type uploadDirOptions struct {
+	checksumManifest bool
+}
+
+// WithChecksumManifest makes UploadDir compute the SHA256 of each file while uploading it, and
+// then write them to dstPrefix/CHECKSUMS.txt in the sha256sum format, "<hex digest>  <path>"
+// lines with paths relative to dstPrefix, so `sha256sum -c CHECKSUMS.txt` verifies a download.
+// A local CHECKSUMS.txt at the root of the directory is replaced by the manifest.
+func WithChecksumManifest() UploadDirOption {
+	return func(o *uploadDirOptions) {
+		o.checksumManifest = true
+	}
+}
+
+// UploadDir uploads all regular files under localDir to dstPrefix, keeping their slash separated
+// paths relative to localDir. Symlinks aren't followed. Files are uploaded one at a time, and the
+// first failure stops the upload, leaving the files already uploaded in place.
+func UploadDir(ctx context.Context, bucketName, dstPrefix, localDir string, opts ...UploadDirOption) error {
+	var o uploadDirOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var manifest bytes.Buffer
+	err := filepath.Walk(localDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if o.checksumManifest && rel == ChecksumsFile {
+			return nil
+		}
+		dstPath := path.Join(dstPrefix, rel)
+		handle, err := createDestinationObject(bucketName, dstPath)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		ctx, cancel := withBucketTimeout(ctx, bucketName)
+		defer cancel()
+		h := sha256.New()
+		dst := newProfiledWriter(ctx, handle)
+		dst.ContentType = inferContentType(dstPath)
+		if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+			dst.CloseWithError(err)
+			return fmt.Errorf("failed uploading %q: %v", localPath, err)
+		}
+		if err := dst.Close(); err != nil {
+			return fmt.Errorf("failed uploading %q: %v", localPath, err)
+		}
+		fmt.Fprintf(&manifest, "%x  %s\n", h.Sum(nil), rel)
+		return nil
+	})
+	if err != nil || !o.checksumManifest {
+		return err
+	}
+	manifestPath := path.Join(dstPrefix, ChecksumsFile)
+	handle, err := createDestinationObject(bucketName, manifestPath)
+	if err != nil {
+		return err
+	}
+	attrs := &storage.ObjectAttrs{ContentType: "text/plain"}
+	if _, err := writeObject(ctx, handle, manifest.Bytes(), attrs); err != nil {
+		return fmt.Errorf("failed writing checksum manifest: %v", err)
+	}
+	return nil
+}
+
+// DownloadDir downloads all files under prefix to dstDir, keeping their paths relative to prefix.
+// It's safe for untrusted buckets: names are checked before anything is downloaded, and it fails
+// without writing any file if one would land outside dstDir, such as "../../etc/passwd" or
+// "/etc/passwd". Writes through symlinks already under dstDir are refused the same way.
+// Files are downloaded one at a time, as stored, and the first failure stops the download.
+func DownloadDir(ctx context.Context, bucketName, prefix, dstDir string) error {
+	prefix = dirPrefix(prefix)
+	var files []*storage.ObjectAttrs
+	var unsafe []string
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		rel := strings.TrimPrefix(attrs.Name, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			// Folder placeholders have no content to download.
+			return nil
+		}
+		if !isLocalRelPath(rel) {
+			unsafe = append(unsafe, attrs.Name)
+			return nil
+		}
+		files = append(files, attrs)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unsafe) > 0 {
+		return fmt.Errorf("refusing to download %d files escaping %q: %s", len(unsafe), dstDir, strings.Join(unsafe, ", "))
+	}
+
+	root, err := filepath.Abs(dstDir)
+	if err != nil {
+		return err
+	}
+	for _, attrs := range files {
+		localPath := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(attrs.Name, prefix)))
+		if err := downloadUnder(ctx, bucketName, attrs, root, localPath); err != nil {
+			return fmt.Errorf("failed downloading %q: %v", attrs.Name, err)
+		}
+	}
+	return nil
+}
+
+// isLocalRelPath checks if the slash separated rel stays under the directory it's relative to,
+// on any OS: it's not empty nor absolute and has no ".." element, nor backslash or drive letter
+// that Windows would read as such.
+func isLocalRelPath(rel string) bool {
+	if rel == "" || strings.Contains(rel, "\\") || path.IsAbs(rel) || (len(rel) >= 2 && rel[1] == ':') {
+		return false
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadUnder downloads the listed generation of attrs to localPath, creating its parent
+// directories, after checking that no existing symlink redirects it outside root
+func downloadUnder(ctx context.Context, bucketName string, attrs *storage.ObjectAttrs, root, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	if err := checkNoSymlinks(root, localPath); err != nil {
+		return err
+	}
+	src, err := createStorageObject(bucketName, attrs.Name).Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, limitByBudget(ctx, src)); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// checkNoSymlinks fails if localPath, or any of its parents up to root, is a symlink
+func checkNoSymlinks(root, localPath string) error {
+	for p := localPath; p != root && strings.HasPrefix(p, root); p = filepath.Dir(p) {
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %q", p)
+		}
+	}
+	return nil
+}
+
+// DiffDir compares the files under localDir with the ones under gcs prefix, by size and CRC32C.
+// It returns the slash separated paths, relative to localDir and prefix, of local files missing
+// or different in gcs (toUpload), of gcs files missing locally (toDelete), and of files identical
+// on both sides (unchanged). It's a dry run of syncing localDir to prefix, nothing is changed.
+// Only regular files are considered locally, symlinks aren't followed. Files stored gzip encoded
+// in gcs always differ from their local counterpart, as their checksum covers the stored bytes.
+func DiffDir(ctx context.Context, bucketName, prefix, localDir string) (toUpload, toDelete, unchanged []string, err error) {
+	prefix = dirPrefix(prefix)
+	remote := make(map[string]*storage.ObjectAttrs)
+	err = iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if rel := strings.TrimPrefix(attrs.Name, prefix); rel != "" && !strings.HasSuffix(rel, "/") {
+			remote[rel] = attrs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = filepath.Walk(localDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		attrs, ok := remote[rel]
+		delete(remote, rel)
+		if !ok || attrs.Size != info.Size() {
+			toUpload = append(toUpload, rel)
+			return nil
+		}
+		sum, err := fileCRC32C(localPath)
+		if err != nil {
+			return err
+		}
+		if sum == attrs.CRC32C {
+			unchanged = append(unchanged, rel)
+		} else {
+			toUpload = append(toUpload, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for rel := range remote {
+		toDelete = append(toDelete, rel)
+	}
+	sort.Strings(toDelete)
+	return toUpload, toDelete, unchanged, nil
+}
+
+// fileCRC32C computes the CRC32C checksum of a local file, as gcs does
+func fileCRC32C(localPath string) (uint32, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crc32cTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
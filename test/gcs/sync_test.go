@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listing answers object listings with the given names, as a single page
+func listing(names ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var items []map[string]string
+		for _, name := range names {
+			items = append(items, map[string]string{"bucket": "bucket", "name": name, "generation": "1"})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items})
+	}
+}
+
+// tempDir creates a temporary directory removed at the end of the test
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gcs-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// isRefusal checks if err is DownloadDir refusing to write outside its directory, rather than
+// failing to download
+func isRefusal(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "refusing")
+}
+
+// assertEmpty fails the test if dir has any entry
+func assertEmpty(t *testing.T, dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", dir, err)
+	}
+	for _, f := range files {
+		t.Errorf("Found %q in %q, want nothing", f.Name(), dir)
+	}
+}
+
+func TestDownloadDirEscape(t *testing.T) {
+	tests := []struct {
+		rel         string
+		wantRefusal bool
+	}{
+		{"../x", true},
+		{"a/../../x", true},
+		{"/etc/passwd", true},
+		{`a\..\x`, true},
+		{"C:x", true},
+		// The prefix itself is a folder placeholder, skipped without being downloaded.
+		{"", false},
+	}
+	for _, test := range tests {
+		t.Run(test.rel, func(t *testing.T) {
+			f := newFakeGCS(t, listing("prefix/"+test.rel))
+			defer f.Close()
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+
+			err := DownloadDir(context.Background(), "bucket", "prefix", dir)
+			if test.wantRefusal && !isRefusal(err) || !test.wantRefusal && err != nil {
+				t.Errorf("DownloadDir() = %v, want refusal %v", err, test.wantRefusal)
+			}
+			assertEmpty(t, dir)
+		})
+	}
+}
+
+func TestDownloadDirSymlink(t *testing.T) {
+	f := newFakeGCS(t, listing("prefix/link/x"))
+	defer f.Close()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	outside, cleanupOutside := tempDir(t)
+	defer cleanupOutside()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := DownloadDir(context.Background(), "bucket", "prefix", dir); !isRefusal(err) {
+		t.Errorf("DownloadDir() = %v, want a refusal", err)
+	}
+	assertEmpty(t, outside)
+	if got := f.requests(); len(got) != 1 {
+		t.Errorf("Got requests %v, want only the listing", got)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// tempobj.go defines the cleanup of temporary gcs files created by operations
+
+package gcs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// tempCleanupTimeout bounds the deletion of the temporary files of an operation
+const tempCleanupTimeout = 30 * time.Second
+
+// tempObjects tracks the temporary files of an operation, to delete them once it's done however
+// it ended. Deletions don't use the operation's context, so they still happen once it's canceled.
+// It's safe for concurrent use.
+type tempObjects struct {
+	bucketName string
+	mu         sync.Mutex
+	paths      []string
+}
+
+// newTempObjects creates a tracker of temporary files in bucketName
+func newTempObjects(bucketName string) *tempObjects {
+	return &tempObjects{bucketName: bucketName}
+}
+
+// add tracks tempPath and returns it. It should be called before starting to write the file,
+// as an interrupted write may still have created it.
+func (t *tempObjects) add(tempPath string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paths = append(t.paths, tempPath)
+	return tempPath
+}
+
+// cleanup deletes the tracked files, logging failures other than files never created
+func (t *tempObjects) cleanup() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), tempCleanupTimeout)
+	defer cancel()
+	for _, p := range t.paths {
+		if err := createStorageObject(t.bucketName, p).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			log.Printf("Failed deleting temporary file %q: %v", p, err)
+		}
+	}
+	t.paths = nil
+}
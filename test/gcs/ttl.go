@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// ttl.go defines application level expiry of gcs files, for buckets without lifecycle rules
+
+package gcs
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ExpiresAtMetadata is the metadata key holding the RFC 3339 expiry time of a file
+const ExpiresAtMetadata = "expires-at"
+
+// UploadWithTTL uploads local srcPath to dstPath with an expiry time ttl from now, stored in
+// its ExpiresAtMetadata metadata. Nothing deletes the file by itself, SweepExpired does.
+// The expiry time comes from the local clock, so clock skew between the uploading machine
+// and the one sweeping shifts when the file is deleted.
+func UploadWithTTL(ctx context.Context, bucketName, dstPath, srcPath string, ttl time.Duration) error {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := newProfiledWriter(ctx, handle)
+	dst.ContentType = inferContentType(dstPath)
+	dst.Metadata = map[string]string{ExpiresAtMetadata: time.Now().Add(ttl).UTC().Format(time.RFC3339)}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.CloseWithError(err)
+		return err
+	}
+	return dst.Close()
+}
+
+// SweepExpired deletes the files under prefix whose ExpiresAtMetadata time is past, per the
+// local clock, and returns the number deleted. Files without expiry time are kept, as are
+// files replaced since they were listed. Expiry times that can't be parsed are logged and kept.
+func SweepExpired(ctx context.Context, bucketName, prefix string) (int, error) {
+	now := time.Now()
+	deleted := 0
+	err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		value, ok := attrs.Metadata[ExpiresAtMetadata]
+		if !ok {
+			return nil
+		}
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Printf("Invalid expiry time %q of %q: %v", value, attrs.Name, err)
+			return nil
+		}
+		if expiresAt.After(now) {
+			return nil
+		}
+		err = createStorageObject(bucketName, attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+		if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		deleted++
+		return nil
+	})
+	return deleted, err
+}
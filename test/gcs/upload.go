@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// upload.go defines functions uploading streams to gcs
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ErrUploadTimeout is returned by UploadReader when the upload exceeds its deadline
+var ErrUploadTimeout = errors.New("gcs: upload exceeded its deadline")
+
+// UploadOption configures UploadReader
+type UploadOption func(*uploadOptions)
+
+// uploadOptions holds the settings of a single UploadReader call
+type uploadOptions struct {
+	deadline         time.Duration
+	progressInterval time.Duration
+}
+
+// uploadProgress is the content of the progress file written along uploads
+type uploadProgress struct {
+	BytesUploaded int64     `json:"bytesUploaded"`
+	Updated       time.Time `json:"updated"`
+}
+
+// WithUploadDeadline caps the total duration of the upload to d, no matter how
+// steadily the source produces data and how far away ctx's deadline is.
+func WithUploadDeadline(d time.Duration) UploadOption {
+	return func(o *uploadOptions) {
+		o.deadline = d
+	}
+}
+
+// WithProgressObject makes the upload write its progress to a small JSON file at
+// "<dstPath>.progress" every interval, with the number of bytes uploaded so far, so that
+// other processes can follow it by polling that file. The progress file is deleted once
+// the upload is over, whether it succeeded or not.
+// Bytes are acknowledged by gcs in chunks, so the count grows by steps of the writer chunk size.
+func WithProgressObject(interval time.Duration) UploadOption {
+	return func(o *uploadOptions) {
+		o.progressInterval = interval
+	}
+}
+
+// UploadReader uploads the content of r to gcs dstPath.
+// With WithUploadDeadline, the upload is aborted once the deadline is exceeded, without
+// creating the object, and ErrUploadTimeout is returned even if r is blocked in Read.
+// The deadline defaults to the timeout of the bucket profile, see SetBucketProfile.
+func UploadReader(ctx context.Context, bucketName, dstPath string, r io.Reader, opts ...UploadOption) error {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	o := uploadOptions{deadline: profileFor(bucketName).Timeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var uploaded int64
+	if o.progressInterval > 0 {
+		stop, err := reportProgress(ctx, bucketName, dstPath+".progress", o.progressInterval, &uploaded)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	// Cancelling the writer's context aborts the upload, the object is only created by a successful Close.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dst := newProfiledWriter(ctx, handle)
+	dst.ProgressFunc = func(n int64) { atomic.StoreInt64(&uploaded, n) }
+	done := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(dst, capUpload(r))
+		if err != nil {
+			dst.CloseWithError(err)
+		} else {
+			err = dst.Close()
+		}
+		auditOp("upload", bucketName, dstPath, n, err)
+		done <- err
+	}()
+
+	var timeout <-chan time.Time
+	if o.deadline > 0 {
+		timer := time.NewTimer(o.deadline)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return ErrUploadTimeout
+	}
+}
+
+// reportProgress writes the value of uploaded to progressPath every interval, until the returned
+// stop function is called, which then deletes progressPath. It fails if the key policy rejects progressPath.
+func reportProgress(ctx context.Context, bucketName, progressPath string, interval time.Duration, uploaded *int64) (stop func(), err error) {
+	temps := newTempObjects(bucketName)
+	handle, err := createDestinationObject(bucketName, temps.add(progressPath))
+	if err != nil {
+		return nil, err
+	}
+	attrs := &storage.ObjectAttrs{ContentType: "application/json"}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			data, _ := json.Marshal(uploadProgress{BytesUploaded: atomic.LoadInt64(uploaded), Updated: time.Now()})
+			if _, err := writeObject(ctx, handle, data, attrs); err != nil {
+				log.Printf("Failed writing upload progress to %q: %v", progressPath, err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		temps.cleanup()
+	}, nil
+}
+
+// UploadFromURL downloads srcURL and streams the response body straight to gcs dstPath, without
+// staging it locally, with the content type of the response. Responses other than 200 OK are an
+// error, and nothing is written then. Cancelling ctx aborts both the download and the upload.
+func UploadFromURL(ctx context.Context, bucketName, dstPath, srcURL string) error {
+	handle, err := createDestinationObject(bucketName, dstPath)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withBucketTimeout(ctx, bucketName)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, srcURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed downloading %q: %s", srcURL, resp.Status)
+	}
+	dst := newProfiledWriter(ctx, handle)
+	dst.ContentType = resp.Header.Get("Content-Type")
+	if dst.ContentType == "" {
+		dst.ContentType = inferContentType(dstPath)
+	}
+	if _, err := io.Copy(dst, capUpload(resp.Body)); err != nil {
+		dst.CloseWithError(err)
+		return fmt.Errorf("failed mirroring %q: %v", srcURL, err)
+	}
+	return dst.Close()
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// url.go defines functions accepting gs:// URLs instead of bucket and path
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// gcsScheme is the prefix of every gcs URL
+	gcsScheme = "gs://"
+	// publicHost serves gcs files over HTTPS
+	publicHost = "storage.googleapis.com"
+)
+
+// ParseURL splits a gcs URL like "gs://bucket/path/to/file" into bucket and object path.
+// Trailing slashes are dropped from the object path, so "gs://bucket/dir/" gives "dir",
+// and "gs://bucket" or "gs://bucket/" gives an empty object path.
+func ParseURL(gsURL string) (bucket, object string, err error) {
+	if !strings.HasPrefix(gsURL, gcsScheme) {
+		return "", "", fmt.Errorf("invalid gcs URL %q: must start with %q", gsURL, gcsScheme)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(gsURL, gcsScheme), "/", 2)
+	bucket = parts[0]
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid gcs URL %q: missing bucket name", gsURL)
+	}
+	if len(parts) == 2 {
+		object = strings.TrimRight(parts[1], "/")
+	}
+	return bucket, object, nil
+}
+
+// PublicURL returns the HTTPS URL serving the file, it's only readable by
+// anonymous users if the file is public.
+func PublicURL(bucketName, filePath string) string {
+	return (&url.URL{Scheme: "https", Host: publicHost, Path: "/" + bucketName + "/" + objectName(filePath)}).String()
+}
+
+// parseObjectURL is ParseURL but also requires the URL to point at an object
+func parseObjectURL(gsURL string) (bucket, object string, err error) {
+	bucket, object, err = ParseURL(gsURL)
+	if err == nil && object == "" {
+		err = fmt.Errorf("invalid gcs URL %q: missing object path", gsURL)
+	}
+	return bucket, object, err
+}
+
+// ExistURL checks if the object at gsURL exists
+func ExistURL(ctx context.Context, gsURL string) bool {
+	bucket, object, err := parseObjectURL(gsURL)
+	if err != nil {
+		return false
+	}
+	return Exist(ctx, bucket, object)
+}
+
+// ReadURL reads the object at gsURL
+func ReadURL(ctx context.Context, gsURL string) ([]byte, error) {
+	bucket, object, err := parseObjectURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	return Read(ctx, bucket, object)
+}
+
+// NewReaderURL creates a new Reader of the object at gsURL.
+// Important: caller must call Close on the returned Reader when done reading
+func NewReaderURL(ctx context.Context, gsURL string) (*storage.Reader, error) {
+	bucket, object, err := parseObjectURL(gsURL)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(ctx, bucket, object)
+}
+
+// DownloadURL downloads the object at gsURL to local dstPath
+func DownloadURL(ctx context.Context, gsURL, dstPath string) error {
+	bucket, object, err := parseObjectURL(gsURL)
+	if err != nil {
+		return err
+	}
+	return Download(ctx, bucket, object, dstPath)
+}
+
+// UploadURL uploads local srcPath to gsURL
+func UploadURL(ctx context.Context, gsURL, srcPath string) error {
+	bucket, object, err := parseObjectURL(gsURL)
+	if err != nil {
+		return err
+	}
+	return Upload(ctx, bucket, object, srcPath)
+}
+
+// CopyURL copies the object at srcURL to dstURL within gcs
+func CopyURL(ctx context.Context, srcURL, dstURL string) error {
+	srcBucket, srcObject, err := parseObjectURL(srcURL)
+	if err != nil {
+		return err
+	}
+	dstBucket, dstObject, err := parseObjectURL(dstURL)
+	if err != nil {
+		return err
+	}
+	return Copy(ctx, srcBucket, srcObject, dstBucket, dstObject)
+}
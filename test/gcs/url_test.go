@@ -0,0 +1,51 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcs
+
+import "testing"
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url        string
+		wantBucket string
+		wantObject string
+		wantErr    bool
+	}{
+		{url: "gs://bucket/path/to/file", wantBucket: "bucket", wantObject: "path/to/file"},
+		{url: "gs://bucket/dir/", wantBucket: "bucket", wantObject: "dir"},
+		{url: "gs://bucket/dir//", wantBucket: "bucket", wantObject: "dir"},
+		{url: "gs://bucket/", wantBucket: "bucket"},
+		{url: "gs://bucket", wantBucket: "bucket"},
+		{url: "gs://bucket/a b", wantBucket: "bucket", wantObject: "a b"},
+		{url: "gs://", wantErr: true},
+		{url: "gs:///file", wantErr: true},
+		{url: "https://bucket/file", wantErr: true},
+		{url: "GS://bucket/file", wantErr: true},
+		{url: "bucket/file", wantErr: true},
+		{url: "", wantErr: true},
+	}
+	for _, test := range tests {
+		bucket, object, err := ParseURL(test.url)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseURL(%q) error = %v, want error %v", test.url, err, test.wantErr)
+			continue
+		}
+		if bucket != test.wantBucket || object != test.wantObject {
+			t.Errorf("ParseURL(%q) = %q, %q, want %q, %q", test.url, bucket, object, test.wantBucket, test.wantObject)
+		}
+	}
+}
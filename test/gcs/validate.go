@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// validate.go defines functions checking the content of gcs files
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// readErrorRecorder remembers the errors of the Reader it wraps, other than io.EOF,
+// to tell failures to fetch content from invalid content.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// ValidateJSONPrefix streams each file under prefix, gzipped or not, through a JSON tokenizer and
+// returns the sorted names of those that aren't valid JSON. Files holding several concatenated JSON
+// values, like newline delimited JSON, are valid, empty files are not. Up to concurrency files are
+// checked at once, and files aren't held in memory.
+func ValidateJSONPrefix(ctx context.Context, bucketName, prefix string, concurrency int) (invalid []string, err error) {
+	var mu sync.Mutex
+	err = forEachObjectParallel(ctx, bucketName, prefix, concurrency, func(ctx context.Context, attrs *storage.ObjectAttrs) error {
+		valid, err := isValidJSON(ctx, bucketName, attrs.Name)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			mu.Lock()
+			invalid = append(invalid, attrs.Name)
+			mu.Unlock()
+		}
+		return nil
+	})
+	sort.Strings(invalid)
+	return invalid, err
+}
+
+// isValidJSON checks if the file is a stream of one or more valid JSON values
+func isValidJSON(ctx context.Context, bucketName, filePath string) (bool, error) {
+	f, err := NewReader(ctx, bucketName, filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	src := &readErrorRecorder{r: limitByBudget(ctx, f)}
+	r, err := maybeGunzip(src)
+	if err != nil {
+		if src.err != nil {
+			return false, src.err
+		}
+		return false, nil
+	}
+	dec := json.NewDecoder(r)
+	// Token reports io.EOF even in the middle of a value, so track nesting to catch truncated files.
+	depth := 0
+	for tokens := 0; ; tokens++ {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return tokens > 0 && depth == 0, nil
+		}
+		if err != nil {
+			if src.err != nil {
+				return false, src.err
+			}
+			return false, nil
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
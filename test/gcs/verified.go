@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// verified.go defines writes and reads that are checked after the fact
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+)
+
+// WriteVerified writes data to filePath, reads it back, and restores the previous content
+// if what was read doesn't match data. The previous content is kept in memory, so this is
+// meant for small critical files like configs.
+// This is not atomic: readers may see the new content between the write and the restore,
+// and the write fails if another writer changed the file since the previous content was read.
+func WriteVerified(ctx context.Context, bucketName, filePath string, data []byte) error {
+	handle, err := createDestinationObject(bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	prior, err := handle.Attrs(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	var priorData []byte
+	conds := storage.Conditions{DoesNotExist: true}
+	if prior != nil {
+		if priorData, err = readGeneration(ctx, handle, prior.Generation); err != nil {
+			return err
+		}
+		conds = storage.Conditions{GenerationMatch: prior.Generation}
+	}
+
+	written, err := writeObject(ctx, handle.If(conds), data, prior)
+	if err != nil {
+		return err
+	}
+	got, err := readGeneration(ctx, handle, written.Generation)
+	if err == nil && bytes.Equal(got, data) {
+		return nil
+	}
+	verifyErr := fmt.Errorf("verification of %q failed: %v", filePath, err)
+	if err == nil {
+		verifyErr = fmt.Errorf("verification of %q failed: read back %d bytes, wrote %d", filePath, len(got), len(data))
+	}
+
+	restored := handle.If(storage.Conditions{GenerationMatch: written.Generation})
+	if prior == nil {
+		err = restored.Delete(ctx)
+	} else {
+		_, err = writeObject(ctx, restored, priorData, prior)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, and restoring the previous content failed: %v", verifyErr, err)
+	}
+	return verifyErr
+}
+
+// CopyVerified is Copy, but then reads the attrs of the destination back and fails if its CRC32C
+// and size don't match the source's, catching the rare corruption of a server-side copy.
+// With DeleteOnMismatch, a mismatching destination is deleted. It costs two more Attrs calls.
+func CopyVerified(ctx context.Context, srcBucket, srcPath, dstBucket, dstPath string, opts ...CopyOption) error {
+	dst, err := createDestinationObject(dstBucket, dstPath)
+	if err != nil {
+		return err
+	}
+	var o copyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	src := createStorageObject(srcBucket, srcPath)
+	srcAttrs, err := src.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	// Pinning the generation keeps a concurrent write to the source from failing the check.
+	copier := dst.CopierFrom(src.Generation(srcAttrs.Generation))
+	if err := withRetry(ctx, dstBucket, func() error {
+		_, err := copier.Run(ctx)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	dstAttrs, err := dst.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if sameContent(srcAttrs, dstAttrs) {
+		return nil
+	}
+	verifyErr := fmt.Errorf("verification of copy of %q to %q failed: CRC32C %08x and size %d, source has %08x and %d",
+		srcPath, dstPath, dstAttrs.CRC32C, dstAttrs.Size, srcAttrs.CRC32C, srcAttrs.Size)
+	if o.deleteOnMismatch {
+		if err := dst.If(storage.Conditions{GenerationMatch: dstAttrs.Generation}).Delete(ctx); err != nil {
+			return fmt.Errorf("%v, and deleting the copy failed: %v", verifyErr, err)
+		}
+	}
+	return verifyErr
+}
+
+// readGeneration reads the given generation of the object
+func readGeneration(ctx context.Context, handle *storage.ObjectHandle, generation int64) ([]byte, error) {
+	r, err := handle.Generation(generation).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(limitByBudget(ctx, r))
+}
+
+// writeObject writes data to handle within the timeout of its bucket's profile, copying content type
+// and metadata from attrs if not nil
+func writeObject(ctx context.Context, handle *storage.ObjectHandle, data []byte, attrs *storage.ObjectAttrs) (*storage.ObjectAttrs, error) {
+	ctx, cancel := withBucketTimeout(ctx, handle.BucketName())
+	defer cancel()
+	w := newProfiledWriter(ctx, handle)
+	if attrs != nil {
+		w.ContentType = attrs.ContentType
+		w.Metadata = attrs.Metadata
+	}
+	if _, err := w.Write(data); err != nil {
+		w.CloseWithError(err)
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+// ReadConsistent reads the specified file reads times and returns its content only if all reads
+// had the same CRC32C, as a paranoid check for critical data. It costs reads full downloads.
+// Reads are of the latest generation each time, so a file changing in between also fails it.
+func ReadConsistent(ctx context.Context, bucketName, filePath string, reads int) ([]byte, error) {
+	var contents []byte
+	var first uint32
+	for i := 0; i < reads || i == 0; i++ {
+		data, err := Read(ctx, bucketName, filePath)
+		if err != nil {
+			return nil, err
+		}
+		sum := crc32.Checksum(data, crc32cTable)
+		if i == 0 {
+			contents, first = data, sum
+		} else if sum != first {
+			return nil, fmt.Errorf("inconsistent reads of %q: read %d has CRC32C %08x, read 1 had %08x", filePath, i+1, sum, first)
+		}
+	}
+	return contents, nil
+}
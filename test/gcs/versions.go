@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// versions.go defines functions managing generations of gcs files in versioned buckets
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCGenerations deletes, for each file under prefix, all but its keep most recent generations,
+// returning the number of generations deleted. The bucket must have versioning enabled.
+// The live generation of a file is always its most recent one, so it's never deleted, and
+// keep must be at least 1. Files which were deleted only have noncurrent generations, the
+// most recent of them are kept the same way.
+func GCGenerations(ctx context.Context, bucketName, prefix string, keep int) (deleted int, err error) {
+	if keep < 1 {
+		return 0, fmt.Errorf("keep must be at least 1, got %d", keep)
+	}
+	if err := requireVersioning(ctx, bucketName); err != nil {
+		return 0, err
+	}
+
+	// Generations of a file are listed next to each other, so only one file is held at a time.
+	var name string
+	var generations []int64
+	flush := func() error {
+		if len(generations) <= keep {
+			return nil
+		}
+		sort.Slice(generations, func(i, j int) bool { return generations[i] > generations[j] })
+		for _, g := range generations[keep:] {
+			err := createStorageObject(bucketName, name).Generation(g).Delete(ctx)
+			if err != nil && err != storage.ErrObjectNotExist {
+				return fmt.Errorf("failed deleting generation %d of %q: %v", g, name, err)
+			}
+			deleted++
+		}
+		return nil
+	}
+	err = iterateQuery(ctx, bucketName, &storage.Query{Prefix: prefix, Versions: true}, func(attrs *storage.ObjectAttrs) error {
+		if attrs.Name != name {
+			if err := flush(); err != nil {
+				return err
+			}
+			name, generations = attrs.Name, nil
+		}
+		generations = append(generations, attrs.Generation)
+		return nil
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, flush()
+}
+
+// ListNoncurrent returns the noncurrent generations of the files under prefix, those replaced
+// or deleted which versioning keeps around, with their Generation and their Deleted time, the
+// time they stopped being live. Restoring one is copying that generation back onto its name.
+// The bucket must have versioning enabled.
+func ListNoncurrent(ctx context.Context, bucketName, prefix string) ([]*storage.ObjectAttrs, error) {
+	if err := requireVersioning(ctx, bucketName); err != nil {
+		return nil, err
+	}
+	var noncurrent []*storage.ObjectAttrs
+	err := iterateQuery(ctx, bucketName, &storage.Query{Prefix: prefix, Versions: true}, func(attrs *storage.ObjectAttrs) error {
+		if !attrs.Deleted.IsZero() {
+			noncurrent = append(noncurrent, attrs)
+		}
+		return nil
+	})
+	return noncurrent, err
+}
+
+// requireVersioning returns an error unless the bucket has versioning enabled
+func requireVersioning(ctx context.Context, bucketName string) error {
+	attrs, err := client.Bucket(bucketName).Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if !attrs.VersioningEnabled {
+		return fmt.Errorf("bucket %q doesn't have versioning enabled", bucketName)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// watch.go defines functions polling gcs for new files and waiting on them
+
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// objectVersion identifies a file generation
+type objectVersion struct {
+	name       string
+	generation int64
+}
+
+// Watch lists prefix every interval and sends each file created or replaced since the previous
+// listing, the files present when Watch is called aren't sent. Listing errors are sent on the
+// error channel and polling goes on. Both channels are closed once ctx is done.
+func Watch(ctx context.Context, bucketName, prefix string, interval time.Duration) (<-chan *storage.ObjectAttrs, <-chan error) {
+	objects := make(chan *storage.ObjectAttrs)
+	errs := make(chan error)
+	go func() {
+		defer close(objects)
+		defer close(errs)
+		var seen map[objectVersion]bool
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			current := make(map[objectVersion]bool)
+			var added []*storage.ObjectAttrs
+			err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+				v := objectVersion{attrs.Name, attrs.Generation}
+				current[v] = true
+				if seen != nil && !seen[v] {
+					added = append(added, attrs)
+				}
+				return nil
+			})
+			if err != nil {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				// Only keep what's still there, so memory follows the size of the prefix.
+				seen = current
+				for _, attrs := range added {
+					select {
+					case objects <- attrs:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return objects, errs
+}
+
+// maxPollBackoff caps the backoff of WaitForCount, in poll intervals, when the bucket's retry
+// policy has no MaxDelay
+const maxPollBackoff = 10
+
+// WaitForCount lists prefix every pollInterval until it holds at least expected files, e.g. the
+// outputs of as many parallel shards. Folder placeholders aren't counted. Listing errors don't
+// stop the wait, they make it back off, doubling the interval up to the MaxDelay of the bucket's
+// retry policy, or to 10 times pollInterval without one. Once ctx is done, it fails with the last
+// count seen and the last listing error, if any.
+func WaitForCount(ctx context.Context, bucketName, prefix string, expected int, pollInterval time.Duration) error {
+	maxDelay := profileFor(bucketName).Retry.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = maxPollBackoff * pollInterval
+	}
+	if maxDelay < pollInterval {
+		maxDelay = pollInterval
+	}
+	delay := pollInterval
+	count := 0
+	var listErr error
+	for {
+		n := 0
+		err := iterateObjects(ctx, bucketName, prefix, "", func(attrs *storage.ObjectAttrs) error {
+			if !strings.HasSuffix(attrs.Name, "/") {
+				n++
+			}
+			return nil
+		})
+		if err == nil {
+			if n >= expected {
+				return nil
+			}
+			count, listErr, delay = n, nil, pollInterval
+		} else if ctx.Err() == nil {
+			listErr = err
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if listErr != nil {
+				return fmt.Errorf("waiting for %d files under %q: %v, last listing failed: %v", expected, prefix, ctx.Err(), listErr)
+			}
+			return fmt.Errorf("waiting for %d files under %q: %v, found %d", expected, prefix, ctx.Err(), count)
+		}
+	}
+}
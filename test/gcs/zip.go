@@ -0,0 +1,159 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// zip.go defines functions reading zip archives stored in gcs without downloading them
+
+package gcs
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// ReaderAt reads a gcs file at random offsets, each ReadAt being a range request.
+// It reads the generation current when it was created, so later changes to the file don't
+// mix with its content. It's safe for concurrent use.
+type ReaderAt struct {
+	ctx    context.Context
+	handle *storage.ObjectHandle
+	size   int64
+}
+
+// NewReaderAt creates a ReaderAt of the specified file
+func NewReaderAt(ctx context.Context, bucketName, filePath string) (*ReaderAt, error) {
+	handle := createStorageObject(bucketName, filePath)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{ctx: ctx, handle: handle.Generation(attrs.Generation), size: attrs.Size}, nil
+}
+
+// Size returns the size of the file
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes at offset off, as specified by io.ReaderAt
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > r.size {
+		length = r.size - off
+	}
+	rr, err := r.handle.NewRangeReader(r.ctx, off, length)
+	if err != nil {
+		return 0, err
+	}
+	defer rr.Close()
+	n, err := io.ReadFull(limitByBudget(r.ctx, rr), p[:length])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ZipEntry is a file of a zip archive
+type ZipEntry struct {
+	Name string
+	// Size is the uncompressed size of the entry
+	Size uint64
+}
+
+// ListZipEntries returns the entries of the zip archive stored at filePath. Only the central
+// directory at the end of the archive is read, with range requests, not the whole archive.
+func ListZipEntries(ctx context.Context, bucketName, filePath string) ([]ZipEntry, error) {
+	ra, err := NewReaderAt(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		return nil, fmt.Errorf("cannot read zip archive %q: %v", filePath, err)
+	}
+	entries := make([]ZipEntry, 0, len(zr.File))
+	for _, f := range zr.File {
+		entries = append(entries, ZipEntry{Name: f.Name, Size: f.UncompressedSize64})
+	}
+	return entries, nil
+}
+
+// ExtractZipEntry streams the content of the entry named entryName of the zip archive stored at
+// filePath to w, reading only the central directory and that entry from gcs. The entry's data is
+// fetched with a single range request and checked against its CRC32.
+// Only stored and deflated entries are supported, which covers archives made by common tools.
+func ExtractZipEntry(ctx context.Context, bucketName, filePath, entryName string, w io.Writer) error {
+	ra, err := NewReaderAt(ctx, bucketName, filePath)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(ra, ra.Size())
+	if err != nil {
+		return fmt.Errorf("cannot read zip archive %q: %v", filePath, err)
+	}
+	var entry *zip.File
+	for _, f := range zr.File {
+		if f.Name == entryName {
+			entry = f
+			break
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("zip archive %q has no entry %q", filePath, entryName)
+	}
+
+	// zip's own entry reader would make a range request per small buffered read.
+	offset, err := entry.DataOffset()
+	if err != nil {
+		return fmt.Errorf("cannot read entry %q of zip archive %q: %v", entryName, filePath, err)
+	}
+	rr, err := ra.handle.NewRangeReader(ctx, offset, int64(entry.CompressedSize64))
+	if err != nil {
+		return err
+	}
+	defer rr.Close()
+	var r io.Reader
+	switch entry.Method {
+	case zip.Store:
+		r = rr
+	case zip.Deflate:
+		fr := flate.NewReader(rr)
+		defer fr.Close()
+		r = fr
+	default:
+		return fmt.Errorf("entry %q of zip archive %q uses unsupported compression method %d", entryName, filePath, entry.Method)
+	}
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, h), limitByBudget(ctx, r))
+	if err != nil {
+		return fmt.Errorf("cannot read entry %q of zip archive %q: %v", entryName, filePath, err)
+	}
+	if uint64(n) != entry.UncompressedSize64 || h.Sum32() != entry.CRC32 {
+		return fmt.Errorf("entry %q of zip archive %q is corrupted", entryName, filePath)
+	}
+	return nil
+}